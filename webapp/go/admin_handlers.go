@@ -0,0 +1,493 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// サポート・管理者向けAPIの認証
+// ISUCON_ADMIN_TOKEN が未設定の場合は管理者APIを無効にする
+func adminAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		adminToken := os.Getenv("ISUCON_ADMIN_TOKEN")
+		if adminToken == "" {
+			writeError(w, http.StatusForbidden, errors.New("admin api is disabled"))
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			writeError(w, http.StatusUnauthorized, errors.New("bearer token is required"))
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(adminToken)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("invalid admin token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type adminGetReferralTreeResponse struct {
+	Roots []*adminReferralNode `json:"roots"`
+}
+
+type adminReferralNode struct {
+	UserID          string               `json:"user_id"`
+	Username        string               `json:"username"`
+	InvitationCode  string               `json:"invitation_code"`
+	RegisteredAt    int64                `json:"registered_at"`
+	InvitedAt       *int64               `json:"invited_at,omitempty"`
+	DescendantCount int                  `json:"descendant_count"`
+	MaxDepth        int                  `json:"max_depth"`
+	Invitees        []*adminReferralNode `json:"invitees"`
+}
+
+// 招待関係の木を返す。user_id を指定するとそのユーザーを根とする部分木のみを返す
+func adminGetReferralTree(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rootUserID := r.URL.Query().Get("user_id")
+
+	rows := []struct {
+		UserID         string         `db:"id"`
+		Username       string         `db:"username"`
+		InvitationCode string         `db:"invitation_code"`
+		CreatedAt      time.Time      `db:"created_at"`
+		InviterID      sql.NullString `db:"inviter_id"`
+		InvitedAt      sql.NullTime   `db:"invited_at"`
+	}{}
+	if err := db.SelectContext(ctx, &rows, `
+		SELECT u.id, u.username, u.invitation_code, u.created_at, i.inviter_id, i.created_at AS invited_at
+		FROM users u
+		LEFT JOIN invitations i ON i.invitee_id = u.id
+		WHERE i.invitee_id IS NOT NULL OR EXISTS (SELECT 1 FROM invitations WHERE inviter_id = u.id)
+		ORDER BY u.created_at
+	`); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	nodes := make(map[string]*adminReferralNode, len(rows))
+	for _, row := range rows {
+		node := &adminReferralNode{
+			UserID:         row.UserID,
+			Username:       row.Username,
+			InvitationCode: row.InvitationCode,
+			RegisteredAt:   row.CreatedAt.UnixMilli(),
+			Invitees:       []*adminReferralNode{},
+		}
+		if row.InvitedAt.Valid {
+			t := row.InvitedAt.Time.UnixMilli()
+			node.InvitedAt = &t
+		}
+		nodes[row.UserID] = node
+	}
+
+	roots := []*adminReferralNode{}
+	for _, row := range rows {
+		node := nodes[row.UserID]
+		if parent, ok := nodes[row.InviterID.String]; row.InviterID.Valid && ok {
+			parent.Invitees = append(parent.Invitees, node)
+		} else {
+			roots = append(roots, node)
+		}
+	}
+
+	if rootUserID != "" {
+		node, ok := nodes[rootUserID]
+		if !ok {
+			writeError(w, http.StatusNotFound, errors.New("user has no referrals"))
+			return
+		}
+		roots = []*adminReferralNode{node}
+	}
+
+	visited := map[string]bool{}
+	for _, root := range roots {
+		summarizeReferralNode(root, visited)
+	}
+
+	writeJSON(w, http.StatusOK, &adminGetReferralTreeResponse{
+		Roots: roots,
+	})
+}
+
+func summarizeReferralNode(node *adminReferralNode, visited map[string]bool) {
+	if visited[node.UserID] {
+		return
+	}
+	visited[node.UserID] = true
+
+	node.DescendantCount = 0
+	node.MaxDepth = 0
+	for _, invitee := range node.Invitees {
+		summarizeReferralNode(invitee, visited)
+		node.DescendantCount += 1 + invitee.DescendantCount
+		node.MaxDepth = max(node.MaxDepth, invitee.MaxDepth+1)
+	}
+}
+
+type adminGetFraudFlagsResponse struct {
+	Flags []adminFraudFlag `json:"flags"`
+}
+
+type adminFraudFlag struct {
+	ID          string  `json:"id"`
+	UserID      string  `json:"user_id"`
+	Reason      string  `json:"reason"`
+	Score       int     `json:"score"`
+	Detail      string  `json:"detail"`
+	HeldCoupons int     `json:"held_coupons"`
+	CreatedAt   int64   `json:"created_at"`
+	ReviewedAt  *int64  `json:"reviewed_at,omitempty"`
+	Resolution  *string `json:"resolution,omitempty"`
+}
+
+// 不正検知の一覧を返す。status=all を指定しない限り未レビューのもののみ
+func adminGetFraudFlags(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	query := "SELECT * FROM fraud_flags WHERE reviewed_at IS NULL ORDER BY created_at"
+	if r.URL.Query().Get("status") == "all" {
+		query = "SELECT * FROM fraud_flags ORDER BY created_at"
+	}
+	flags := []FraudFlag{}
+	if err := db.SelectContext(ctx, &flags, query); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	heldCounts := []struct {
+		UserID string `db:"user_id"`
+		Count  int    `db:"count"`
+	}{}
+	if err := db.SelectContext(ctx, &heldCounts, "SELECT user_id, COUNT(*) AS count FROM coupons WHERE held_at IS NOT NULL AND used_by IS NULL GROUP BY user_id"); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	heldCountByUserID := make(map[string]int, len(heldCounts))
+	for _, c := range heldCounts {
+		heldCountByUserID[c.UserID] = c.Count
+	}
+
+	res := adminGetFraudFlagsResponse{Flags: []adminFraudFlag{}}
+	for _, flag := range flags {
+		f := adminFraudFlag{
+			ID:          flag.ID,
+			UserID:      flag.UserID,
+			Reason:      flag.Reason,
+			Score:       flag.Score,
+			Detail:      flag.Detail,
+			HeldCoupons: heldCountByUserID[flag.UserID],
+			CreatedAt:   flag.CreatedAt.UnixMilli(),
+			Resolution:  flag.Resolution,
+		}
+		if flag.ReviewedAt != nil {
+			t := flag.ReviewedAt.UnixMilli()
+			f.ReviewedAt = &t
+		}
+		res.Flags = append(res.Flags, f)
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+type adminPostFraudFlagReviewRequest struct {
+	Resolution string `json:"resolution"`
+}
+
+// 不正検知をレビューする
+// released なら保留していたクーポンを戻し、revoked なら保留したままにする
+func adminPostFraudFlagReview(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	flagID := r.PathValue("flag_id")
+
+	req := &adminPostFraudFlagReviewRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Resolution != "released" && req.Resolution != "revoked" {
+		writeError(w, http.StatusBadRequest, errors.New("resolution must be released or revoked"))
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	flag := &FraudFlag{}
+	if err := tx.GetContext(ctx, flag, "SELECT * FROM fraud_flags WHERE id = ? FOR UPDATE", flagID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("fraud flag not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if flag.ReviewedAt != nil {
+		writeError(w, http.StatusConflict, errors.New("fraud flag is already reviewed"))
+		return
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE fraud_flags SET reviewed_at = CURRENT_TIMESTAMP(6), resolution = ? WHERE id = ?", req.Resolution, flag.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if req.Resolution == "released" {
+		fraudConfig, err := getFraudConfig(ctx, tx)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if err := releaseCoupons(ctx, tx, fraudConfig, flag); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type adminGetRideSupportFlagsResponse struct {
+	Flags []adminRideSupportFlag `json:"flags"`
+}
+
+type adminRideSupportFlag struct {
+	ID         string `json:"id"`
+	RideID     string `json:"ride_id"`
+	ChairID    string `json:"chair_id"`
+	Reason     string `json:"reason"`
+	Detail     string `json:"detail"`
+	CreatedAt  int64  `json:"created_at"`
+	ResolvedAt *int64 `json:"resolved_at,omitempty"`
+}
+
+// サポートの対応が必要なライドの一覧を返す。status=all を指定しない限り未対応のもののみ
+func adminGetRideSupportFlags(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	query := "SELECT * FROM ride_support_flags WHERE resolved_at IS NULL ORDER BY created_at"
+	if r.URL.Query().Get("status") == "all" {
+		query = "SELECT * FROM ride_support_flags ORDER BY created_at"
+	}
+	flags := []RideSupportFlag{}
+	if err := db.SelectContext(ctx, &flags, query); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := adminGetRideSupportFlagsResponse{Flags: []adminRideSupportFlag{}}
+	for _, flag := range flags {
+		f := adminRideSupportFlag{
+			ID:        flag.ID,
+			RideID:    flag.RideID,
+			ChairID:   flag.ChairID,
+			Reason:    flag.Reason,
+			Detail:    flag.Detail,
+			CreatedAt: flag.CreatedAt.UnixMilli(),
+		}
+		if flag.ResolvedAt != nil {
+			t := flag.ResolvedAt.UnixMilli()
+			f.ResolvedAt = &t
+		}
+		res.Flags = append(res.Flags, f)
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+func adminPostRideSupportFlagResolve(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	flagID := r.PathValue("flag_id")
+
+	result, err := db.ExecContext(ctx, "UPDATE ride_support_flags SET resolved_at = CURRENT_TIMESTAMP(6) WHERE id = ? AND resolved_at IS NULL", flagID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if count, err := result.RowsAffected(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if count == 0 {
+		var exists bool
+		if err := db.GetContext(ctx, &exists, "SELECT EXISTS (SELECT 1 FROM ride_support_flags WHERE id = ?)", flagID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if !exists {
+			writeError(w, http.StatusNotFound, errors.New("ride support flag not found"))
+			return
+		}
+		writeError(w, http.StatusConflict, errors.New("ride support flag is already resolved"))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type adminPostReconciliationRequest struct {
+	Enqueue bool `json:"enqueue"`
+}
+
+// 決済の突き合わせをその場で実行してレポートを返す
+func adminPostReconciliation(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	req := &adminPostReconciliationRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var paymentGatewayURL string
+	if err := db.GetContext(ctx, &paymentGatewayURL, "SELECT value FROM settings WHERE name = 'payment_gateway_url'"); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	report, err := reconcilePayments(ctx, newPaymentGateway(paymentGatewayURL), req.Enqueue)
+	if err != nil {
+		writeError(w, paymentGatewayErrorStatus(err), err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
+
+type adminPostRideRefundRequest struct {
+	// 省略した場合は返金されていない残額をすべて返金する
+	Amount int    `json:"amount"`
+	Reason string `json:"reason"`
+}
+
+type adminPostRideRefundResponse struct {
+	ID        string `json:"id"`
+	RideID    string `json:"ride_id"`
+	Amount    int    `json:"amount"`
+	Reason    string `json:"reason"`
+	Status    string `json:"status"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// ライドの決済を全額または一部返金する
+func adminPostRideRefund(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rideID := r.PathValue("ride_id")
+
+	req := &adminPostRideRefundRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Reason == "" {
+		writeError(w, http.StatusBadRequest, errors.New("reason is required but was empty"))
+		return
+	}
+	if req.Amount < 0 {
+		writeError(w, http.StatusBadRequest, errors.New("amount must be positive"))
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	payment := &Payment{}
+	if err := tx.GetContext(ctx, payment, "SELECT * FROM payments WHERE ride_id = ? FOR UPDATE", rideID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("payment for the ride not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if payment.Status != "succeeded" {
+		writeError(w, http.StatusConflict, errors.New("payment is not settled yet"))
+		return
+	}
+
+	var refunded int
+	if err := tx.GetContext(ctx, &refunded, "SELECT IFNULL(SUM(amount), 0) FROM refunds WHERE payment_id = ? AND status != 'failed'", payment.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	remaining := payment.Amount - refunded
+	amount := req.Amount
+	if amount == 0 {
+		amount = remaining
+	}
+	if amount <= 0 || amount > remaining {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("amount must be between 1 and %d", remaining))
+		return
+	}
+
+	// 返金中の額も含めて残額を判定できるよう、決済マイクロサービスに送る前に記録する
+	// ここで試行している間はワーカーが同じ返金を取らないよう、試行中として記録する
+	refund := &Refund{ID: ulid.Make().String()}
+	if _, err := tx.ExecContext(
+		ctx,
+		"INSERT INTO refunds (id, payment_id, ride_id, amount, reason, attempts, next_attempt_at) VALUES (?, ?, ?, ?, ?, 1, CURRENT_TIMESTAMP(6) + INTERVAL ? SECOND)",
+		refund.ID, payment.ID, rideID, amount, req.Reason, int(paymentWorkerLease.Seconds()),
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := tx.GetContext(ctx, refund, "SELECT * FROM refunds WHERE id = ?", refund.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	var paymentGatewayURL string
+	if err := db.GetContext(ctx, &paymentGatewayURL, "SELECT value FROM settings WHERE name = 'payment_gateway_url'"); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// 返金されたかどうかわからない失敗は pending のまま残し、ワーカーが同じ冪等キーでリトライする
+	attemptErr, err := settleRefund(ctx, newPaymentGateway(paymentGatewayURL), payment.Token, refund)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	// ブレーカーが開いている間はすぐに 503 を返す。返金は pending のまま残り、ワーカーがリトライする
+	if refund.Status == "failed" || errors.Is(attemptErr, errPaymentGatewayUnavailable) {
+		writeError(w, paymentGatewayErrorStatus(attemptErr), attemptErr)
+		return
+	}
+
+	statusCode := http.StatusCreated
+	if refund.Status == "pending" {
+		statusCode = http.StatusAccepted
+	}
+	writeJSON(w, statusCode, &adminPostRideRefundResponse{
+		ID:        refund.ID,
+		RideID:    refund.RideID,
+		Amount:    refund.Amount,
+		Reason:    refund.Reason,
+		Status:    refund.Status,
+		CreatedAt: refund.CreatedAt.UnixMilli(),
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 	"time"
@@ -69,23 +70,24 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	fraudConfig, err := getFraudConfig(ctx, tx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
 	// 招待コードを使った登録
+	inviterID := ""
 	if req.InvitationCode != nil && *req.InvitationCode != "" {
-		// 招待する側の招待数をチェック
-		var coupons []Coupon
-		err = tx.SelectContext(ctx, &coupons, "SELECT * FROM coupons WHERE code = ? FOR UPDATE", "INV_"+*req.InvitationCode)
+		config, err := getInvitationConfig(ctx, tx)
 		if err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
-		if len(coupons) >= 3 {
-			writeError(w, http.StatusBadRequest, errors.New("この招待コードは使用できません。"))
-			return
-		}
 
 		// ユーザーチェック
 		var inviter User
-		err = tx.GetContext(ctx, &inviter, "SELECT * FROM users WHERE invitation_code = ?", *req.InvitationCode)
+		err = tx.GetContext(ctx, &inviter, "SELECT * FROM users WHERE invitation_code = ? FOR UPDATE", *req.InvitationCode)
 		if err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
 				writeError(w, http.StatusBadRequest, errors.New("この招待コードは使用できません。"))
@@ -95,26 +97,65 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// 招待する側の招待数をチェック
+		var invitedCount int
+		if err := tx.GetContext(ctx, &invitedCount, "SELECT COUNT(*) FROM invitations WHERE inviter_id = ?", inviter.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if invitedCount >= config.MaxUses {
+			writeError(w, http.StatusBadRequest, errors.New("この招待コードは使用できません。"))
+			return
+		}
+
 		// 招待クーポン付与
 		_, err = tx.ExecContext(
 			ctx,
 			"INSERT INTO coupons (user_id, code, discount) VALUES (?, ?, ?)",
-			userID, "INV_"+*req.InvitationCode, 1500,
+			userID, "INV_"+*req.InvitationCode, config.InviteeDiscount,
 		)
 		if err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
 		// 招待した人にもRewardを付与
+		rewardCouponCode := fmt.Sprintf("RWD_%s_%d", *req.InvitationCode, time.Now().UnixMilli())
 		_, err = tx.ExecContext(
 			ctx,
-			"INSERT INTO coupons (user_id, code, discount) VALUES (?, CONCAT(?, '_', FLOOR(UNIX_TIMESTAMP(NOW(3))*1000)), ?)",
-			inviter.ID, "RWD_"+*req.InvitationCode, 1000,
+			"INSERT INTO coupons (user_id, code, discount) VALUES (?, ?, ?)",
+			inviter.ID, rewardCouponCode, config.InviterReward,
 		)
 		if err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
+		// 不正の疑いでクーポンを保留されている招待者には、新しい報酬も保留したまま付与する
+		if err := holdIssuedCoupon(ctx, tx, fraudConfig, inviter.ID, rewardCouponCode); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		_, err = tx.ExecContext(
+			ctx,
+			"INSERT INTO invitations (invitee_id, inviter_id, invitation_code, reward_coupon_code) VALUES (?, ?, ?, ?)",
+			userID, inviter.ID, *req.InvitationCode, rewardCouponCode,
+		)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		inviterID = inviter.ID
+	}
+
+	// 不正な登録の疑いがあればクーポンを保留する
+	signals, err := detectSignupFraud(ctx, tx, fraudConfig, userID, req.FirstName, req.LastName, req.DateOfBirth, inviterID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := recordFraudSignals(ctx, tx, fraudConfig, signals); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -135,7 +176,9 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 }
 
 type appPostPaymentMethodsRequest struct {
-	Token string `json:"token"`
+	Token     string `json:"token"`
+	Label     string `json:"label"`
+	IsDefault bool   `json:"is_default"`
 }
 
 func appPostPaymentMethods(w http.ResponseWriter, r *http.Request) {
@@ -152,20 +195,337 @@ func appPostPaymentMethods(w http.ResponseWriter, r *http.Request) {
 
 	user := ctx.Value("user").(*User)
 
-	_, err := db.ExecContext(
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	// 同じユーザーの決済手段の登録を直列化する
+	if _, err := tx.ExecContext(ctx, "SELECT id FROM users WHERE id = ? FOR UPDATE", user.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	paymentTokens := []PaymentToken{}
+	if err := tx.SelectContext(ctx, &paymentTokens, "SELECT * FROM payment_tokens WHERE user_id = ? AND deleted_at IS NULL", user.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	for _, paymentToken := range paymentTokens {
+		if paymentToken.Token == req.Token {
+			writeError(w, http.StatusConflict, errors.New("payment method already registered"))
+			return
+		}
+	}
+
+	paymentMethodID := ulid.Make().String()
+	_, err = tx.ExecContext(
 		ctx,
-		`INSERT INTO payment_tokens (user_id, token) VALUES (?, ?)`,
+		`INSERT INTO payment_tokens (id, user_id, token, label) VALUES (?, ?, ?, ?)`,
+		paymentMethodID,
 		user.ID,
 		req.Token,
+		req.Label,
 	)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
+	// 最初に登録した決済手段はデフォルトにする
+	if req.IsDefault || len(paymentTokens) == 0 {
+		if err := setDefaultPaymentMethod(ctx, tx, user.ID, paymentMethodID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	// 他のユーザーと同じ決済トークンであればクーポンを保留する
+	fraudConfig, err := getFraudConfig(ctx, tx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	signals, err := detectPaymentTokenFraud(ctx, tx, fraudConfig, user.ID, req.Token)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := recordFraudSignals(ctx, tx, fraudConfig, signals); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type appGetPaymentMethodsResponse struct {
+	PaymentMethods []appGetPaymentMethodsResponseItem `json:"payment_methods"`
+}
+
+type appGetPaymentMethodsResponseItem struct {
+	ID        string `json:"id"`
+	Label     string `json:"label"`
+	IsDefault bool   `json:"is_default"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+func appGetPaymentMethods(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value("user").(*User)
+
+	paymentTokens := []PaymentToken{}
+	if err := db.SelectContext(
+		ctx,
+		&paymentTokens,
+		"SELECT * FROM payment_tokens WHERE user_id = ? AND deleted_at IS NULL ORDER BY created_at",
+		user.ID,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	items := make([]appGetPaymentMethodsResponseItem, 0, len(paymentTokens))
+	for _, paymentToken := range paymentTokens {
+		items = append(items, appGetPaymentMethodsResponseItem{
+			ID:        paymentToken.ID,
+			Label:     paymentToken.Label,
+			IsDefault: paymentToken.IsDefault,
+			CreatedAt: paymentToken.CreatedAt.UnixMilli(),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, &appGetPaymentMethodsResponse{
+		PaymentMethods: items,
+	})
+}
+
+func appDeletePaymentMethod(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value("user").(*User)
+	paymentMethodID := r.PathValue("payment_method_id")
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "SELECT id FROM users WHERE id = ? FOR UPDATE", user.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	paymentToken, err := getPaymentMethod(ctx, tx, user.ID, paymentMethodID)
+	if err != nil {
+		if errors.Is(err, errPaymentMethodNotFound) {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// 過去のライドの決済や突き合わせで参照するので論理削除する
+	if _, err := tx.ExecContext(
+		ctx,
+		"UPDATE payment_tokens SET deleted_at = CURRENT_TIMESTAMP(6), is_default = 0 WHERE id = ?",
+		paymentToken.ID,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// デフォルトを削除したら最後に登録した決済手段をデフォルトにする
+	if paymentToken.IsDefault {
+		next, err := getDefaultPaymentMethod(ctx, tx, user.ID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if next != nil {
+			if err := setDefaultPaymentMethod(ctx, tx, user.ID, next.ID); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func appPostDefaultPaymentMethod(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value("user").(*User)
+	paymentMethodID := r.PathValue("payment_method_id")
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "SELECT id FROM users WHERE id = ? FOR UPDATE", user.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if _, err := getPaymentMethod(ctx, tx, user.ID, paymentMethodID); err != nil {
+		if errors.Is(err, errPaymentMethodNotFound) {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := setDefaultPaymentMethod(ctx, tx, user.ID, paymentMethodID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
+type appPostInvitationCodeRequest struct {
+	InvitationCode string `json:"invitation_code"`
+}
+
+type appPostInvitationCodeResponse struct {
+	InvitationCode string `json:"invitation_code"`
+}
+
+// 招待コードを任意の文字列に変更する
+func appPostInvitationCode(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	req := &appPostInvitationCodeRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !vanityInvitationCodePattern.MatchString(req.InvitationCode) {
+		writeError(w, http.StatusBadRequest, errors.New("invitation_code must be 4-30 characters of alphanumerics, '_' or '-'"))
+		return
+	}
+
+	user := ctx.Value("user").(*User)
+
+	// 使われているかどうかは一意制約で判定する
+	if _, err := db.ExecContext(ctx, "UPDATE users SET invitation_code = ? WHERE id = ?", req.InvitationCode, user.ID); err != nil {
+		if isDuplicateEntryError(err) {
+			writeError(w, http.StatusConflict, errors.New("invitation_code is already taken"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &appPostInvitationCodeResponse{
+		InvitationCode: req.InvitationCode,
+	})
+}
+
+type appGetReferralsResponse struct {
+	InvitationCode  string                        `json:"invitation_code"`
+	MaxUses         int                           `json:"max_uses"`
+	RemainingUses   int                           `json:"remaining_uses"`
+	TotalReward     int                           `json:"total_reward"`
+	UsedRewardCount int                           `json:"used_reward_count"`
+	Referrals       []appGetReferralsResponseItem `json:"referrals"`
+}
+
+type appGetReferralsResponseItem struct {
+	UserID     string `json:"user_id"`
+	Username   string `json:"username"`
+	Reward     int    `json:"reward"`
+	RewardUsed bool   `json:"reward_used"`
+	InvitedAt  int64  `json:"invited_at"`
+}
+
+// 自分の招待コードで登録したユーザーと、獲得した報酬を返す
+func appGetReferrals(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value("user").(*User)
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	config, err := getInvitationConfig(ctx, tx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	referrals := []struct {
+		InviteeID  string         `db:"invitee_id"`
+		Username   string         `db:"username"`
+		Reward     sql.NullInt64  `db:"reward"`
+		RewardUsed sql.NullString `db:"reward_used_by"`
+		CreatedAt  time.Time      `db:"created_at"`
+	}{}
+	if err := tx.SelectContext(ctx, &referrals, `
+		SELECT i.invitee_id, u.username, c.discount AS reward, c.used_by AS reward_used_by, i.created_at
+		FROM invitations i
+		JOIN users u ON u.id = i.invitee_id
+		LEFT JOIN coupons c ON c.user_id = i.inviter_id AND c.code = i.reward_coupon_code
+		WHERE i.inviter_id = ?
+		ORDER BY i.created_at
+	`, user.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := appGetReferralsResponse{
+		InvitationCode: user.InvitationCode,
+		MaxUses:        config.MaxUses,
+		RemainingUses:  max(config.MaxUses-len(referrals), 0),
+		Referrals:      []appGetReferralsResponseItem{},
+	}
+	for _, referral := range referrals {
+		item := appGetReferralsResponseItem{
+			UserID:     referral.InviteeID,
+			Username:   referral.Username,
+			Reward:     int(referral.Reward.Int64),
+			RewardUsed: referral.RewardUsed.Valid,
+			InvitedAt:  referral.CreatedAt.UnixMilli(),
+		}
+		res.TotalReward += item.Reward
+		if item.RewardUsed {
+			res.UsedRewardCount++
+		}
+		res.Referrals = append(res.Referrals, item)
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
 type getAppRidesResponse struct {
 	Rides []getAppRidesResponseItem `json:"rides"`
 }
@@ -177,6 +537,8 @@ type getAppRidesResponseItem struct {
 	Chair                 getAppRidesResponseItemChair `json:"chair"`
 	Fare                  int                          `json:"fare"`
 	Evaluation            int                          `json:"evaluation"`
+	PaymentStatus         *string                      `json:"payment_status,omitempty"`
+	PaymentMethodID       *string                      `json:"payment_method_id,omitempty"`
 	RequestedAt           int64                        `json:"requested_at"`
 	CompletedAt           int64                        `json:"completed_at"`
 }
@@ -255,6 +617,19 @@ func appGetRides(w http.ResponseWriter, r *http.Request) {
 		}
 		item.Chair.Owner = owner.Name
 
+		paymentStatus := ""
+		if err := tx.GetContext(ctx, &paymentStatus, `SELECT status FROM payments WHERE ride_id = ?`, ride.ID); err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+		} else {
+			item.PaymentStatus = &paymentStatus
+		}
+		if ride.PaymentTokenID.Valid {
+			item.PaymentMethodID = &ride.PaymentTokenID.String
+		}
+
 		items = append(items, item)
 	}
 
@@ -271,6 +646,8 @@ func appGetRides(w http.ResponseWriter, r *http.Request) {
 type appPostRidesRequest struct {
 	PickupCoordinate      *Coordinate `json:"pickup_coordinate"`
 	DestinationCoordinate *Coordinate `json:"destination_coordinate"`
+	// 省略した場合はデフォルトの決済手段を使う
+	PaymentMethodID string `json:"payment_method_id"`
 }
 
 type appPostRidesResponse struct {
@@ -336,11 +713,35 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var paymentToken *PaymentToken
+	if req.PaymentMethodID != "" {
+		paymentToken, err = getPaymentMethod(ctx, tx, user.ID, req.PaymentMethodID)
+		if err != nil {
+			if errors.Is(err, errPaymentMethodNotFound) {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	} else {
+		paymentToken, err = getDefaultPaymentMethod(ctx, tx, user.ID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	// 決済手段が未登録なら評価時のデフォルトを使う
+	paymentTokenID := sql.NullString{}
+	if paymentToken != nil {
+		paymentTokenID = sql.NullString{String: paymentToken.ID, Valid: true}
+	}
+
 	if _, err := tx.ExecContext(
 		ctx,
-		`INSERT INTO rides (id, user_id, pickup_latitude, pickup_longitude, destination_latitude, destination_longitude)
-				  VALUES (?, ?, ?, ?, ?, ?)`,
-		rideID, user.ID, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude,
+		`INSERT INTO rides (id, user_id, pickup_latitude, pickup_longitude, destination_latitude, destination_longitude, payment_token_id)
+				  VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		rideID, user.ID, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude, paymentTokenID,
 	); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
@@ -361,17 +762,19 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	fare := calculateFare(req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
+
 	var coupon Coupon
 	if rideCount == 1 {
 		// 初回利用で、初回利用クーポンがあれば必ず使う
-		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND code = 'CP_NEW2024' AND used_by IS NULL FOR UPDATE", user.ID); err != nil {
+		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND code = 'CP_NEW2024' AND "+usableCouponCondition+" FOR UPDATE", user.ID, fare); err != nil {
 			if !errors.Is(err, sql.ErrNoRows) {
 				writeError(w, http.StatusInternalServerError, err)
 				return
 			}
 
 			// 無ければ他のクーポンを付与された順番に使う
-			if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at LIMIT 1 FOR UPDATE", user.ID); err != nil {
+			if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND "+usableCouponCondition+" ORDER BY created_at LIMIT 1 FOR UPDATE", user.ID, fare); err != nil {
 				if !errors.Is(err, sql.ErrNoRows) {
 					writeError(w, http.StatusInternalServerError, err)
 					return
@@ -398,7 +801,7 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 		}
 	} else {
 		// 他のクーポンを付与された順番に使う
-		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at LIMIT 1 FOR UPDATE", user.ID); err != nil {
+		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND "+usableCouponCondition+" ORDER BY created_at LIMIT 1 FOR UPDATE", user.ID, fare); err != nil {
 			if !errors.Is(err, sql.ErrNoRows) {
 				writeError(w, http.StatusInternalServerError, err)
 				return
@@ -421,7 +824,7 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fare, err := calculateDiscountedFare(ctx, tx, user.ID, &ride, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
+	discountedFare, err := calculateDiscountedFare(ctx, tx, user.ID, &ride, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
@@ -434,7 +837,7 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 
 	writeJSON(w, http.StatusAccepted, &appPostRidesResponse{
 		RideID: rideID,
-		Fare:   fare,
+		Fare:   discountedFare,
 	})
 }
 
@@ -580,9 +983,9 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	paymentToken := &PaymentToken{}
-	if err := tx.GetContext(ctx, paymentToken, `SELECT * FROM payment_tokens WHERE user_id = ?`, ride.UserID); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
+	paymentToken, err := getRidePaymentMethod(ctx, tx, ride)
+	if err != nil {
+		if errors.Is(err, errPaymentMethodNotFound) {
 			writeError(w, http.StatusBadRequest, errors.New("payment token not registered"))
 			return
 		}
@@ -595,27 +998,23 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-	paymentGatewayRequest := &paymentGatewayPostPaymentRequest{
-		Amount: fare,
-	}
 
-	var paymentGatewayURL string
-	if err := tx.GetContext(ctx, &paymentGatewayURL, "SELECT value FROM settings WHERE name = 'payment_gateway_url'"); err != nil {
+	if err := recordRideSale(ctx, tx, ride, fare); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := postRideLedger(ctx, tx, ride, fare); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	if err := requestPaymentGatewayPostPayment(ctx, paymentGatewayURL, paymentToken.Token, paymentGatewayRequest, func() ([]Ride, error) {
-		rides := []Ride{}
-		if err := tx.SelectContext(ctx, &rides, `SELECT * FROM rides WHERE user_id = ? ORDER BY created_at ASC`, ride.UserID); err != nil {
-			return nil, err
-		}
-		return rides, nil
-	}); err != nil {
-		if errors.Is(err, erroredUpstream) {
-			writeError(w, http.StatusBadGateway, err)
-			return
-		}
+	// 決済はワーカーが非同期に行う
+	payment := newRidePayment(ride, paymentToken, fare)
+	if _, err := tx.ExecContext(
+		ctx,
+		"INSERT INTO payments (id, ride_id, user_id, token, amount) VALUES (?, ?, ?, ?, ?)",
+		payment.ID, payment.RideID, payment.UserID, payment.Token, payment.Amount,
+	); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
@@ -964,7 +1363,7 @@ func calculateFare(pickupLatitude, pickupLongitude, destLatitude, destLongitude
 
 func calculateDiscountedFare(ctx context.Context, tx *sqlx.Tx, userID string, ride *Ride, pickupLatitude, pickupLongitude, destLatitude, destLongitude int) (int, error) {
 	var coupon Coupon
-	discount := 0
+	var appliedCoupon *Coupon
 	if ride != nil {
 		destLatitude = ride.DestinationLatitude
 		destLongitude = ride.DestinationLongitude
@@ -977,30 +1376,31 @@ func calculateDiscountedFare(ctx context.Context, tx *sqlx.Tx, userID string, ri
 				return 0, err
 			}
 		} else {
-			discount = coupon.Discount
+			appliedCoupon = &coupon
 		}
 	} else {
+		fare := calculateFare(pickupLatitude, pickupLongitude, destLatitude, destLongitude)
+
 		// 初回利用クーポンを最優先で使う
-		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND code = 'CP_NEW2024' AND used_by IS NULL", userID); err != nil {
+		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND code = 'CP_NEW2024' AND "+usableCouponCondition, userID, fare); err != nil {
 			if !errors.Is(err, sql.ErrNoRows) {
 				return 0, err
 			}
 
 			// 無いなら他のクーポンを付与された順番に使う
-			if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at LIMIT 1", userID); err != nil {
+			if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND "+usableCouponCondition+" ORDER BY created_at LIMIT 1", userID, fare); err != nil {
 				if !errors.Is(err, sql.ErrNoRows) {
 					return 0, err
 				}
 			} else {
-				discount = coupon.Discount
+				appliedCoupon = &coupon
 			}
 		} else {
-			discount = coupon.Discount
+			appliedCoupon = &coupon
 		}
 	}
 
 	meteredFare := farePerDistance * calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude)
-	discountedMeteredFare := max(meteredFare-discount, 0)
 
-	return initialFare + discountedMeteredFare, nil
+	return initialFare + meteredFare - calculateCouponDiscount(appliedCoupon, meteredFare), nil
 }
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 受付状態を変更した理由
+const (
+	// 椅子自身が変更した
+	chairActivityReasonChair = "chair"
+	// オーナーが強制的に停止した
+	chairActivityReasonSuspended = "suspended"
+	// オーナーが引退させた
+	chairActivityReasonRetired = "retired"
+	// 位置情報が途絶えたため自動で停止した
+	chairActivityReasonStale = "stale"
+	// 自動で停止した後に位置情報が届いたため受付を再開した
+	chairActivityReasonResumed = "resumed"
+)
+
+// この時間内に受付状態が chairFlappingThreshold 回以上変わった椅子は不安定とみなす
+const (
+	chairFlappingWindow    = 10 * time.Minute
+	chairFlappingThreshold = 6
+)
+
+// 受付状態の変更を履歴に追記する。状態が変わったときだけ呼ぶ
+func recordChairActivity(ctx context.Context, tx *sqlx.Tx, chairID string, isActive bool, reason string) error {
+	_, err := tx.ExecContext(
+		ctx,
+		"INSERT INTO chair_activities (chair_id, is_active, reason) VALUES (?, ?, ?)",
+		chairID, isActive, reason,
+	)
+	return err
+}
+
+// 期間中の変更履歴を椅子ごとに古い順に返す
+// 期間が始まった時点の状態がわかるよう、期間より前の最後の変更も含める
+func getChairActivities(ctx context.Context, chairIDs []string, since, until time.Time) (map[string][]ChairActivity, error) {
+	activitiesByChairID := make(map[string][]ChairActivity, len(chairIDs))
+	if len(chairIDs) == 0 {
+		return activitiesByChairID, nil
+	}
+
+	query, args, err := sqlx.In(
+		`SELECT * FROM chair_activities WHERE id IN (
+		   SELECT MAX(id) FROM chair_activities WHERE chair_id IN (?) AND created_at < ? GROUP BY chair_id
+		 )
+		 UNION ALL
+		 SELECT * FROM chair_activities WHERE chair_id IN (?) AND created_at BETWEEN ? AND ? + INTERVAL 999 MICROSECOND
+		 ORDER BY id`,
+		chairIDs, since, chairIDs, since, until,
+	)
+	if err != nil {
+		return nil, err
+	}
+	activities := []ChairActivity{}
+	if err := db.SelectContext(ctx, &activities, query, args...); err != nil {
+		return nil, err
+	}
+	for _, a := range activities {
+		activitiesByChairID[a.ChairID] = append(activitiesByChairID[a.ChairID], a)
+	}
+	return activitiesByChairID, nil
+}
+
+type chairActivitySummary struct {
+	// 期間中に受付中だった時間
+	OnlineMs int64 `json:"online_ms"`
+	// 期間中に受付状態が変わった回数
+	Changes  int  `json:"changes"`
+	Flapping bool `json:"flapping"`
+}
+
+// getChairActivities で取得した1脚分の履歴から、期間中の受付時間と状態の変化を求める
+func summarizeChairActivities(activities []ChairActivity, since, until time.Time) chairActivitySummary {
+	if now := time.Now(); until.After(now) {
+		until = now
+	}
+
+	summary := chairActivitySummary{}
+	active := false
+	from := since
+	inPeriod := []time.Time{}
+	for _, a := range activities {
+		if a.CreatedAt.Before(since) {
+			active = a.IsActive
+			continue
+		}
+		if active {
+			summary.OnlineMs += a.CreatedAt.Sub(from).Milliseconds()
+		}
+		active = a.IsActive
+		from = a.CreatedAt
+		inPeriod = append(inPeriod, a.CreatedAt)
+	}
+	if active && until.After(from) {
+		summary.OnlineMs += until.Sub(from).Milliseconds()
+	}
+
+	summary.Changes = len(inPeriod)
+	for i, j := 0, 0; j < len(inPeriod); j++ {
+		for inPeriod[j].Sub(inPeriod[i]) > chairFlappingWindow {
+			i++
+		}
+		if j-i+1 >= chairFlappingThreshold {
+			summary.Flapping = true
+			break
+		}
+	}
+	return summary
+}
+
+type ownerGetChairActivitiesResponse struct {
+	ChairID string `json:"chair_id"`
+	chairActivitySummary
+	Activities []ownerChairActivity `json:"activities"`
+}
+
+type ownerChairActivity struct {
+	IsActive  bool   `json:"is_active"`
+	Reason    string `json:"reason"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// 期間 (since, until) 中の椅子の受付状態の変更履歴と受付時間を返す
+func ownerGetChairActivities(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	chairID := r.PathValue("chair_id")
+
+	since, until, err := parseSalesPeriod(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var exists bool
+	if err := db.GetContext(ctx, &exists, "SELECT EXISTS (SELECT 1 FROM chairs WHERE id = ? AND owner_id = ?)", chairID, owner.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, errChairNotFound)
+		return
+	}
+
+	activitiesByChairID, err := getChairActivities(ctx, []string{chairID}, since, until)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	activities := activitiesByChairID[chairID]
+
+	res := ownerGetChairActivitiesResponse{
+		ChairID:              chairID,
+		chairActivitySummary: summarizeChairActivities(activities, since, until),
+		Activities:           []ownerChairActivity{},
+	}
+	for _, a := range activities {
+		if a.CreatedAt.Before(since) {
+			continue
+		}
+		res.Activities = append(res.Activities, ownerChairActivity{
+			IsActive:  a.IsActive,
+			Reason:    a.Reason,
+			CreatedAt: a.CreatedAt.UnixMilli(),
+		})
+	}
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 送信された位置情報までの移動距離を累計に加え、最後の位置情報を更新する
+// ON DUPLICATE KEY UPDATE は左から順に評価されるので、距離は更新前の位置から求まる
+func addChairDistance(ctx context.Context, tx *sqlx.Tx, location *ChairLocation) error {
+	_, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO chair_distances (chair_id, total_distance, latitude, longitude, updated_at) VALUES (?, 0, ?, ?, ?)
+		 ON DUPLICATE KEY UPDATE
+		   total_distance = total_distance + ABS(latitude - VALUES(latitude)) + ABS(longitude - VALUES(longitude)),
+		   latitude = VALUES(latitude),
+		   longitude = VALUES(longitude),
+		   updated_at = VALUES(updated_at)`,
+		location.ChairID, location.Latitude, location.Longitude, location.CreatedAt,
+	)
+	return err
+}
+
+type chairDistanceBackfillSummary struct {
+	Chairs int `json:"chairs"`
+}
+
+// chair_locations から椅子ごとの累計移動距離を計算し直す
+// 計算中に送信された位置情報と競合しないよう、椅子ごとに累計の行をロックしてから計算する
+func backfillChairDistances(ctx context.Context) (*chairDistanceBackfillSummary, error) {
+	chairIDs := []string{}
+	if err := db.SelectContext(ctx, &chairIDs, "SELECT DISTINCT chair_id FROM chair_locations"); err != nil {
+		return nil, err
+	}
+
+	summary := &chairDistanceBackfillSummary{}
+	for _, chairID := range chairIDs {
+		if err := backfillChairDistance(ctx, chairID); err != nil {
+			return summary, err
+		}
+		summary.Chairs++
+	}
+	return summary, nil
+}
+
+func backfillChairDistance(ctx context.Context, chairID string) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "SELECT 1 FROM chair_distances WHERE chair_id = ? FOR UPDATE", chairID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO chair_distances (chair_id, total_distance, latitude, longitude, updated_at)
+		 SELECT chair_id, IFNULL(SUM(distance), 0), MAX(last_latitude), MAX(last_longitude), MAX(created_at) FROM (
+		   SELECT chair_id, created_at,
+		          ABS(latitude - LAG(latitude) OVER w) + ABS(longitude - LAG(longitude) OVER w) AS distance,
+		          LAST_VALUE(latitude) OVER (w ROWS BETWEEN UNBOUNDED PRECEDING AND UNBOUNDED FOLLOWING) AS last_latitude,
+		          LAST_VALUE(longitude) OVER (w ROWS BETWEEN UNBOUNDED PRECEDING AND UNBOUNDED FOLLOWING) AS last_longitude
+		   FROM chair_locations
+		   WHERE chair_id = ?
+		   WINDOW w AS (ORDER BY created_at)
+		 ) distances
+		 GROUP BY chair_id
+		 ON DUPLICATE KEY UPDATE
+		   total_distance = VALUES(total_distance),
+		   latitude = VALUES(latitude),
+		   longitude = VALUES(longitude),
+		   updated_at = VALUES(updated_at)`,
+		chairID,
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
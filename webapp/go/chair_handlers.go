@@ -32,10 +32,23 @@ func chairPostChairs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	owner := &Owner{}
-	if err := db.GetContext(ctx, owner, "SELECT * FROM owners WHERE chair_register_token = ?", req.ChairRegisterToken); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			writeError(w, http.StatusUnauthorized, errors.New("invalid chair_register_token"))
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	owner, registerToken, err := resolveChairRegisterToken(ctx, tx, req.ChairRegisterToken, req.Model)
+	if err != nil {
+		var rejection *chairRegistrationRejection
+		if errors.As(err, &rejection) {
+			// 拒否した記録はロールバックされないようトランザクションの外で書く
+			if err := recordChairRegistration(ctx, db, r, req, owner, registerToken, nil, &rejection.reason); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			writeError(w, rejection.status, fmt.Errorf("invalid chair_register_token: %s", rejection.reason))
 			return
 		}
 		writeError(w, http.StatusInternalServerError, err)
@@ -45,7 +58,7 @@ func chairPostChairs(w http.ResponseWriter, r *http.Request) {
 	chairID := ulid.Make().String()
 	accessToken := secureRandomStr(32)
 
-	_, err := db.ExecContext(
+	_, err = tx.ExecContext(
 		ctx,
 		"INSERT INTO chairs (id, owner_id, name, model, is_active, access_token) VALUES (?, ?, ?, ?, ?, ?)",
 		chairID, owner.ID, req.Name, req.Model, false, accessToken,
@@ -55,6 +68,22 @@ func chairPostChairs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if registerToken != nil {
+		if _, err := tx.ExecContext(ctx, "UPDATE chair_register_tokens SET registered_count = registered_count + 1 WHERE id = ?", registerToken.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	if err := recordChairRegistration(ctx, tx, r, req, owner, registerToken, &chairID, nil); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
 	http.SetCookie(w, &http.Cookie{
 		Path:  "/",
 		Name:  "chair_session",
@@ -81,11 +110,45 @@ func chairPostActivity(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err := db.ExecContext(ctx, "UPDATE chairs SET is_active = ? WHERE id = ?", req.IsActive, chair.ID)
+	// オーナーが停止した椅子や引退した椅子は受付を再開できない
+	if req.IsActive {
+		var locked bool
+		if err := db.GetContext(ctx, &locked, "SELECT suspended_at IS NOT NULL OR retired_at IS NOT NULL FROM chairs WHERE id = ?", chair.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if locked {
+			writeError(w, http.StatusForbidden, errors.New("chair is suspended or retired by the owner"))
+			return
+		}
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "UPDATE chairs SET is_active = ? WHERE id = ? AND (NOT ? OR (suspended_at IS NULL AND retired_at IS NULL))", req.IsActive, chair.ID, req.IsActive)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	// 状態が変わったときだけ履歴に残す
+	if changed, err := result.RowsAffected(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if changed > 0 {
+		if err := recordChairActivity(ctx, tx, chair.ID, req.IsActive, chairActivityReasonChair); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -104,8 +167,15 @@ func chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
 
 	chair := ctx.Value("chair").(*Chair)
 
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
 	chairLocationID := ulid.Make().String()
-	if _, err := db.ExecContext(
+	if _, err := tx.ExecContext(
 		ctx,
 		`INSERT INTO chair_locations (id, chair_id, latitude, longitude) VALUES (?, ?, ?, ?)`,
 		chairLocationID, chair.ID, req.Latitude, req.Longitude,
@@ -115,11 +185,31 @@ func chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
 	}
 
 	location := &ChairLocation{}
-	if err := db.GetContext(ctx, location, `SELECT * FROM chair_locations WHERE id = ?`, chairLocationID); err != nil {
+	if err := tx.GetContext(ctx, location, `SELECT * FROM chair_locations WHERE id = ?`, chairLocationID); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
+	if err := addChairDistance(ctx, tx, location); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	reactivated := false
+	if !chair.IsActive {
+		reactivated, err = reactivateStaleChair(ctx, tx, chair.ID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if reactivated {
+		cacheDeleteChair(chair.AccessToken)
+	}
+
 	ride := &Ride{}
 	if err := db.GetContext(ctx, ride, `SELECT * FROM rides WHERE chair_id = ? ORDER BY updated_at DESC LIMIT 1`, chair.ID); err != nil {
 		if !errors.Is(err, sql.ErrNoRows) {
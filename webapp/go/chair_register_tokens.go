@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+// 椅子登録を拒否した理由
+const (
+	chairRegistrationInvalidToken  = "invalid_token"
+	chairRegistrationRevoked       = "revoked"
+	chairRegistrationExpired       = "expired"
+	chairRegistrationLimitReached  = "limit_reached"
+	chairRegistrationModelMismatch = "model_mismatch"
+)
+
+type chairRegistrationRejection struct {
+	status int
+	reason string
+}
+
+func (e *chairRegistrationRejection) Error() string {
+	return "chair registration rejected: " + e.reason
+}
+
+// 椅子登録トークンからオーナーを特定する
+// オーナーのトークンなら制限はなく、制限付きトークンなら行ロックを取って制限を確認する
+func resolveChairRegisterToken(ctx context.Context, tx *sqlx.Tx, token string, model string) (*Owner, *ChairRegisterToken, error) {
+	owner := &Owner{}
+	err := tx.GetContext(ctx, owner, "SELECT * FROM owners WHERE chair_register_token = ?", token)
+	if err == nil {
+		return owner, nil, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, err
+	}
+
+	registerToken := &ChairRegisterToken{}
+	if err := tx.GetContext(ctx, registerToken, "SELECT * FROM chair_register_tokens WHERE token = ? FOR UPDATE", token); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, &chairRegistrationRejection{status: http.StatusUnauthorized, reason: chairRegistrationInvalidToken}
+		}
+		return nil, nil, err
+	}
+	if err := tx.GetContext(ctx, owner, "SELECT * FROM owners WHERE id = ?", registerToken.OwnerID); err != nil {
+		return nil, nil, err
+	}
+
+	var rejection *chairRegistrationRejection
+	switch {
+	case registerToken.RevokedAt != nil:
+		rejection = &chairRegistrationRejection{status: http.StatusUnauthorized, reason: chairRegistrationRevoked}
+	case registerToken.ExpiresAt != nil && !registerToken.ExpiresAt.After(time.Now()):
+		rejection = &chairRegistrationRejection{status: http.StatusUnauthorized, reason: chairRegistrationExpired}
+	case registerToken.MaxChairs != nil && registerToken.RegisteredCount >= *registerToken.MaxChairs:
+		rejection = &chairRegistrationRejection{status: http.StatusForbidden, reason: chairRegistrationLimitReached}
+	case registerToken.Model != nil && *registerToken.Model != model:
+		rejection = &chairRegistrationRejection{status: http.StatusBadRequest, reason: chairRegistrationModelMismatch}
+	}
+	if rejection != nil {
+		return owner, registerToken, rejection
+	}
+	return owner, registerToken, nil
+}
+
+// 椅子登録の結果を監査ログに残す
+func recordChairRegistration(ctx context.Context, execer sqlx.ExecerContext, r *http.Request, req *chairPostChairsRequest, owner *Owner, registerToken *ChairRegisterToken, chairID *string, reason *string) error {
+	var ownerID, registerTokenID *string
+	if owner != nil {
+		ownerID = &owner.ID
+	}
+	if registerToken != nil {
+		registerTokenID = &registerToken.ID
+	}
+	result := "succeeded"
+	if reason != nil {
+		result = "rejected"
+	}
+	_, err := execer.ExecContext(
+		ctx,
+		`INSERT INTO chair_registrations (id, owner_id, register_token_id, chair_id, name, model, result, reason, remote_addr, user_agent)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		ulid.Make().String(), ownerID, registerTokenID, chairID, req.Name, req.Model, result, reason, r.RemoteAddr, r.UserAgent(),
+	)
+	return err
+}
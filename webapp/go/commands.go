@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+// サーバーとは別に実行する運用コマンド
+// 例: ./isuride reconcile -enqueue, ./isuride close-payouts -date 2024-11-25
+func runCommand(ctx context.Context, name string, args []string) error {
+	switch name {
+	case "reconcile":
+		return runReconcileCommand(ctx, args)
+	case "close-payouts":
+		return runClosePayoutsCommand(ctx, args)
+	case "backfill-chair-distances":
+		return runBackfillChairDistancesCommand(ctx, args)
+	default:
+		return fmt.Errorf("unknown command: %s", name)
+	}
+}
+
+func runReconcileCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	enqueue := fs.Bool("enqueue", false, "決済に失敗したまま決済されていないライドを payments に積み直す")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var paymentGatewayURL string
+	if err := db.GetContext(ctx, &paymentGatewayURL, "SELECT value FROM settings WHERE name = 'payment_gateway_url'"); err != nil {
+		return err
+	}
+	report, err := reconcilePayments(ctx, newPaymentGateway(paymentGatewayURL), *enqueue)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+func runClosePayoutsCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("close-payouts", flag.ExitOnError)
+	date := fs.String("date", "", "締める期間の開始日 (YYYY-MM-DD, UTC)。省略すると終わっている期間をすべて締める")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var summaries []*payoutPeriodSummary
+	if *date != "" {
+		periodStart, err := time.Parse(time.DateOnly, *date)
+		if err != nil {
+			return err
+		}
+		summary, err := closePayoutPeriod(ctx, periodStart)
+		if err != nil {
+			return err
+		}
+		summaries = []*payoutPeriodSummary{summary}
+	} else {
+		var err error
+		summaries, err = closeDuePayoutPeriods(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(summaries)
+}
+
+// chair_distances を導入する前から動いているデータベースで、記録済みの位置情報から累計移動距離を作る
+// 初期化したデータベースでは 4-migration.sql で作られる
+func runBackfillChairDistancesCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("backfill-chair-distances", flag.ExitOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	summary, err := backfillChairDistances(ctx)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(summary)
+}
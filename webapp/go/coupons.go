@@ -0,0 +1,34 @@
+package main
+
+const (
+	// 固定額を割り引く。discount が割引額
+	couponTypeFixed = "fixed"
+	// 距離料金を割合で割り引く。discount が割引率(%)で、max_discount があればそれが上限
+	couponTypePercentage = "percentage"
+	// 初乗り運賃を無料にする
+	couponTypeFreeBaseFare = "free_base_fare"
+)
+
+// 未使用・期限内・保留されておらず、指定した運賃(割引前)以上の最低運賃条件を満たすクーポンの条件
+// プレースホルダには割引前の運賃を渡す
+const usableCouponCondition = "used_by IS NULL AND held_at IS NULL AND (expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP(6)) AND min_fare <= ?"
+
+// クーポンを適用したときの割引額を求める
+// 距離料金に対する割引は距離料金を超えず、初乗り運賃は free_base_fare でのみ割り引かれる
+func calculateCouponDiscount(coupon *Coupon, meteredFare int) int {
+	if coupon == nil {
+		return 0
+	}
+	switch coupon.Type {
+	case couponTypePercentage:
+		discount := meteredFare * coupon.Discount / 100
+		if coupon.MaxDiscount != nil {
+			discount = min(discount, *coupon.MaxDiscount)
+		}
+		return min(max(discount, 0), meteredFare)
+	case couponTypeFreeBaseFare:
+		return initialFare
+	default:
+		return min(max(coupon.Discount, 0), meteredFare)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+type ownerFleetResponse struct {
+	Chairs []ownerFleetChair `json:"chairs"`
+	// UnixMilli
+	GeneratedAt int64 `json:"generated_at"`
+}
+
+type ownerFleetChair struct {
+	ID        string      `json:"id"`
+	Name      string      `json:"name"`
+	Model     string      `json:"model"`
+	Active    bool        `json:"active"`
+	Suspended bool        `json:"suspended"`
+	Location  *Coordinate `json:"location"`
+	// 最後に位置を送ってきた日時 (UnixMilli) と、それからの経過時間
+	LocationUpdatedAt      *int64          `json:"location_updated_at"`
+	MsSinceLocationUpdated *int64          `json:"ms_since_location_updated"`
+	Ride                   *ownerFleetRide `json:"ride"`
+}
+
+type ownerFleetRide struct {
+	ID                    string     `json:"id"`
+	Status                string     `json:"status"`
+	PickupCoordinate      Coordinate `json:"pickup_coordinate"`
+	DestinationCoordinate Coordinate `json:"destination_coordinate"`
+	// UnixMilli
+	RequestedAt int64 `json:"requested_at"`
+}
+
+// オーナーの引退していない椅子の現在の位置と、走行中のライドを取得する
+func getOwnerFleet(ctx context.Context, ownerID string) (*ownerFleetResponse, error) {
+	chairs := []struct {
+		ID                string        `db:"id"`
+		Name              string        `db:"name"`
+		Model             string        `db:"model"`
+		IsActive          bool          `db:"is_active"`
+		SuspendedAt       sql.NullTime  `db:"suspended_at"`
+		Latitude          sql.NullInt64 `db:"latitude"`
+		Longitude         sql.NullInt64 `db:"longitude"`
+		LocationUpdatedAt sql.NullTime  `db:"location_updated_at"`
+	}{}
+	if err := db.SelectContext(
+		ctx,
+		&chairs,
+		`SELECT c.id, c.name, c.model, c.is_active, c.suspended_at, cl.latitude, cl.longitude, cl.created_at AS location_updated_at
+		 FROM chairs c
+		 LEFT JOIN chair_locations cl ON cl.id = (SELECT id FROM chair_locations WHERE chair_id = c.id ORDER BY created_at DESC LIMIT 1)
+		 WHERE c.owner_id = ? AND c.retired_at IS NULL
+		 ORDER BY c.created_at`,
+		ownerID,
+	); err != nil {
+		return nil, err
+	}
+
+	rides := []struct {
+		Ride
+		Status string `db:"status"`
+	}{}
+	if err := db.SelectContext(
+		ctx,
+		&rides,
+		`SELECT r.*, (SELECT status FROM ride_statuses WHERE ride_id = r.id ORDER BY created_at DESC LIMIT 1) AS status
+		 FROM rides r
+		 JOIN chairs c ON c.id = r.chair_id
+		 WHERE c.owner_id = ? AND NOT EXISTS (SELECT 1 FROM ride_statuses WHERE ride_id = r.id AND status = 'COMPLETED')
+		 ORDER BY r.created_at`,
+		ownerID,
+	); err != nil {
+		return nil, err
+	}
+	// 完了していないライドが複数ある椅子は最も新しいライドを表示する
+	rideByChairID := make(map[string]*ownerFleetRide, len(rides))
+	for _, ride := range rides {
+		rideByChairID[ride.ChairID.String] = &ownerFleetRide{
+			ID:                    ride.ID,
+			Status:                ride.Status,
+			PickupCoordinate:      Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude},
+			DestinationCoordinate: Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude},
+			RequestedAt:           ride.CreatedAt.UnixMilli(),
+		}
+	}
+
+	now := time.Now()
+	res := &ownerFleetResponse{
+		Chairs:      make([]ownerFleetChair, 0, len(chairs)),
+		GeneratedAt: now.UnixMilli(),
+	}
+	for _, chair := range chairs {
+		c := ownerFleetChair{
+			ID:        chair.ID,
+			Name:      chair.Name,
+			Model:     chair.Model,
+			Active:    chair.IsActive,
+			Suspended: chair.SuspendedAt.Valid,
+			Ride:      rideByChairID[chair.ID],
+		}
+		if chair.LocationUpdatedAt.Valid {
+			c.Location = &Coordinate{Latitude: int(chair.Latitude.Int64), Longitude: int(chair.Longitude.Int64)}
+			updatedAt := chair.LocationUpdatedAt.Time.UnixMilli()
+			elapsed := now.Sub(chair.LocationUpdatedAt.Time).Milliseconds()
+			c.LocationUpdatedAt = &updatedAt
+			c.MsSinceLocationUpdated = &elapsed
+		}
+		res.Chairs = append(res.Chairs, c)
+	}
+	return res, nil
+}
+
+// 1オーナーあたりの同時に開けるストリームの数
+const ownerFleetStreamMaxPerOwner = 3
+
+var (
+	ownerFleetStreams     = map[string]int{}
+	ownerFleetStreamsLock sync.Mutex
+)
+
+// ストリームの枠を確保する。上限に達していれば false を返す
+func acquireOwnerFleetStream(ownerID string) bool {
+	ownerFleetStreamsLock.Lock()
+	defer ownerFleetStreamsLock.Unlock()
+	if ownerFleetStreams[ownerID] >= ownerFleetStreamMaxPerOwner {
+		return false
+	}
+	ownerFleetStreams[ownerID]++
+	return true
+}
+
+func releaseOwnerFleetStream(ownerID string) {
+	ownerFleetStreamsLock.Lock()
+	defer ownerFleetStreamsLock.Unlock()
+	if ownerFleetStreams[ownerID] <= 1 {
+		delete(ownerFleetStreams, ownerID)
+	} else {
+		ownerFleetStreams[ownerID]--
+	}
+}
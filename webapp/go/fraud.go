@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+// 不正検知の設定。settings テーブルに無い項目はデフォルト値を使う
+type fraudConfig struct {
+	// 期間内の未レビューの検知スコアの合計がこれ以上になったらクーポンを保留する
+	HoldScoreThreshold int
+	// スコアを合計する期間
+	ScoreWindow time.Duration
+
+	SharedPaymentTokenScore int
+	DuplicateIdentityScore  int
+	InvitationBurstScore    int
+	InvitationChainScore    int
+
+	// この期間内に同じ招待コードが InvitationBurstCount 回以上使われていたら短時間の集中利用とみなす
+	InvitationBurstWindow time.Duration
+	InvitationBurstCount  int
+	// 招待されてからこの期間内に他人を招待していたら招待の連鎖とみなす
+	InvitationChainWindow time.Duration
+}
+
+// 招待の集中利用と連鎖が重なっただけでは保留しない
+var defaultFraudConfig = fraudConfig{
+	HoldScoreThreshold:      70,
+	ScoreWindow:             7 * 24 * time.Hour,
+	SharedPaymentTokenScore: 70,
+	DuplicateIdentityScore:  40,
+	InvitationBurstScore:    30,
+	InvitationChainScore:    20,
+	InvitationBurstWindow:   10 * time.Minute,
+	InvitationBurstCount:    2,
+	InvitationChainWindow:   time.Hour,
+}
+
+// 期間の設定値は秒で指定する
+func getFraudConfig(ctx context.Context, tx *sqlx.Tx) (*fraudConfig, error) {
+	settings := []struct {
+		Name  string `db:"name"`
+		Value string `db:"value"`
+	}{}
+	if err := tx.SelectContext(ctx, &settings, "SELECT name, value FROM settings WHERE name LIKE 'fraud\\_%'"); err != nil {
+		return nil, err
+	}
+
+	config := defaultFraudConfig
+	for _, setting := range settings {
+		v, err := strconv.Atoi(setting.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid setting %s: %w", setting.Name, err)
+		}
+		switch setting.Name {
+		case "fraud_hold_threshold":
+			config.HoldScoreThreshold = v
+		case "fraud_score_window":
+			config.ScoreWindow = time.Duration(v) * time.Second
+		case "fraud_score_shared_token":
+			config.SharedPaymentTokenScore = v
+		case "fraud_score_dup_identity":
+			config.DuplicateIdentityScore = v
+		case "fraud_score_invite_burst":
+			config.InvitationBurstScore = v
+		case "fraud_score_invite_chain":
+			config.InvitationChainScore = v
+		case "fraud_burst_window":
+			config.InvitationBurstWindow = time.Duration(v) * time.Second
+		case "fraud_burst_count":
+			config.InvitationBurstCount = v
+		case "fraud_chain_window":
+			config.InvitationChainWindow = time.Duration(v) * time.Second
+		}
+	}
+	return &config, nil
+}
+
+type fraudSignal struct {
+	UserID string
+	Reason string
+	Score  int
+	Detail string
+}
+
+// ユーザー登録時の不正の兆候を調べる。inviterID は招待コードを使っていない場合は空文字
+func detectSignupFraud(ctx context.Context, tx *sqlx.Tx, config *fraudConfig, userID string, firstname, lastname, dateOfBirth string, inviterID string) ([]fraudSignal, error) {
+	signals := []fraudSignal{}
+
+	// 同じ氏名・生年月日のユーザー
+	var duplicateCount int
+	if err := tx.GetContext(ctx, &duplicateCount, "SELECT COUNT(*) FROM users WHERE firstname = ? AND lastname = ? AND date_of_birth = ? AND id != ?", firstname, lastname, dateOfBirth, userID); err != nil {
+		return nil, err
+	}
+	if duplicateCount > 0 {
+		signals = append(signals, fraudSignal{
+			UserID: userID,
+			Reason: "duplicate_identity",
+			Score:  config.DuplicateIdentityScore,
+			Detail: fmt.Sprintf("%d other users have the same name and date of birth", duplicateCount),
+		})
+	}
+
+	if inviterID == "" {
+		return signals, nil
+	}
+
+	// 同じ招待コードの短時間での集中利用。今回の登録より前の利用だけを数える
+	var recentInvitationCount int
+	if err := tx.GetContext(ctx, &recentInvitationCount, "SELECT COUNT(*) FROM invitations WHERE inviter_id = ? AND invitee_id != ? AND created_at > CURRENT_TIMESTAMP(6) - INTERVAL ? SECOND", inviterID, userID, int(config.InvitationBurstWindow.Seconds())); err != nil {
+		return nil, err
+	}
+	if recentInvitationCount >= config.InvitationBurstCount {
+		detail := fmt.Sprintf("invitation code used %d times within %s before this signup", recentInvitationCount, config.InvitationBurstWindow)
+		signals = append(signals,
+			fraudSignal{UserID: userID, Reason: "invitation_burst", Score: config.InvitationBurstScore, Detail: detail},
+			fraudSignal{UserID: inviterID, Reason: "invitation_burst", Score: config.InvitationBurstScore, Detail: detail},
+		)
+	}
+
+	// 招待されたばかりのユーザーによる招待
+	var chained bool
+	if err := tx.GetContext(ctx, &chained, "SELECT EXISTS(SELECT 1 FROM invitations WHERE invitee_id = ? AND created_at > CURRENT_TIMESTAMP(6) - INTERVAL ? SECOND)", inviterID, int(config.InvitationChainWindow.Seconds())); err != nil {
+		return nil, err
+	}
+	if chained {
+		signals = append(signals, fraudSignal{
+			UserID: userID,
+			Reason: "invitation_chain",
+			Score:  config.InvitationChainScore,
+			Detail: fmt.Sprintf("inviter %s was invited within %s", inviterID, config.InvitationChainWindow),
+		})
+	}
+
+	return signals, nil
+}
+
+// 決済トークン登録時の不正の兆候を調べる
+func detectPaymentTokenFraud(ctx context.Context, tx *sqlx.Tx, config *fraudConfig, userID string, token string) ([]fraudSignal, error) {
+	otherUserIDs := []string{}
+	if err := tx.SelectContext(ctx, &otherUserIDs, "SELECT user_id FROM payment_tokens WHERE token = ? AND user_id != ?", token, userID); err != nil {
+		return nil, err
+	}
+	if len(otherUserIDs) == 0 {
+		return nil, nil
+	}
+
+	signals := []fraudSignal{{
+		UserID: userID,
+		Reason: "shared_payment_token",
+		Score:  config.SharedPaymentTokenScore,
+		Detail: fmt.Sprintf("payment token is shared with %v", otherUserIDs),
+	}}
+	for _, otherUserID := range otherUserIDs {
+		signals = append(signals, fraudSignal{
+			UserID: otherUserID,
+			Reason: "shared_payment_token",
+			Score:  config.SharedPaymentTokenScore,
+			Detail: fmt.Sprintf("payment token is shared with %s", userID),
+		})
+	}
+	return signals, nil
+}
+
+// 検知結果を記録し、期間内の未レビューのスコアが閾値を超えたユーザーのクーポンを保留する
+// 保留したクーポンには閾値を超えるきっかけになった検知を記録する
+func recordFraudSignals(ctx context.Context, tx *sqlx.Tx, config *fraudConfig, signals []fraudSignal) error {
+	userIDs := []string{}
+	lastFlagIDByUserID := map[string]string{}
+	for _, signal := range signals {
+		flagID := ulid.Make().String()
+		if _, err := tx.ExecContext(
+			ctx,
+			"INSERT INTO fraud_flags (id, user_id, reason, score, detail) VALUES (?, ?, ?, ?, ?)",
+			flagID, signal.UserID, signal.Reason, signal.Score, signal.Detail,
+		); err != nil {
+			return err
+		}
+		if _, ok := lastFlagIDByUserID[signal.UserID]; !ok {
+			userIDs = append(userIDs, signal.UserID)
+		}
+		lastFlagIDByUserID[signal.UserID] = flagID
+	}
+
+	for _, userID := range userIDs {
+		score, err := getPendingFraudScore(ctx, tx, config, userID)
+		if err != nil {
+			return err
+		}
+		if score < config.HoldScoreThreshold {
+			continue
+		}
+		if err := holdCoupons(ctx, tx, userID, lastFlagIDByUserID[userID]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 期間内の未レビューの検知スコアの合計
+func getPendingFraudScore(ctx context.Context, tx *sqlx.Tx, config *fraudConfig, userID string) (int, error) {
+	var score int
+	err := tx.GetContext(
+		ctx,
+		&score,
+		"SELECT IFNULL(SUM(score), 0) FROM fraud_flags WHERE user_id = ? AND reviewed_at IS NULL AND created_at > CURRENT_TIMESTAMP(6) - INTERVAL ? SECOND",
+		userID, int(config.ScoreWindow.Seconds()),
+	)
+	return score, err
+}
+
+// ユーザーの未使用クーポンと、そのユーザーを招待したことで招待者に付与されたクーポンを flagID の検知によるものとして保留する
+func holdCoupons(ctx context.Context, tx *sqlx.Tx, userID string, flagID string) error {
+	if _, err := tx.ExecContext(ctx, "UPDATE coupons SET held_at = CURRENT_TIMESTAMP(6), held_by = ? WHERE user_id = ? AND used_by IS NULL AND held_at IS NULL", flagID, userID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE coupons c
+		JOIN invitations i ON c.user_id = i.inviter_id AND c.code = i.reward_coupon_code
+		SET c.held_at = CURRENT_TIMESTAMP(6), c.held_by = ?
+		WHERE i.invitee_id = ? AND c.used_by IS NULL AND c.held_at IS NULL
+	`, flagID, userID); err != nil {
+		return err
+	}
+	return nil
+}
+
+// 保留の対象になっているユーザーに後から付与したクーポンも、最新の未レビューの検知によるものとして保留する
+func holdIssuedCoupon(ctx context.Context, tx *sqlx.Tx, config *fraudConfig, userID string, code string) error {
+	score, err := getPendingFraudScore(ctx, tx, config, userID)
+	if err != nil {
+		return err
+	}
+	if score < config.HoldScoreThreshold {
+		return nil
+	}
+	_, err = tx.ExecContext(
+		ctx,
+		`UPDATE coupons SET held_at = CURRENT_TIMESTAMP(6), held_by = (
+		   SELECT id FROM fraud_flags WHERE user_id = ? AND reviewed_at IS NULL ORDER BY created_at DESC LIMIT 1
+		 ) WHERE user_id = ? AND code = ? AND used_by IS NULL AND held_at IS NULL`,
+		userID, userID, code,
+	)
+	return err
+}
+
+// レビューした検知によって保留したクーポンを利用可能に戻す
+// 他の未レビューの検知だけでまだ閾値を超えている場合は、保留したままその検知に引き継ぐ
+func releaseCoupons(ctx context.Context, tx *sqlx.Tx, config *fraudConfig, flag *FraudFlag) error {
+	score, err := getPendingFraudScore(ctx, tx, config, flag.UserID)
+	if err != nil {
+		return err
+	}
+	if score >= config.HoldScoreThreshold {
+		_, err := tx.ExecContext(
+			ctx,
+			`UPDATE coupons SET held_by = (
+			   SELECT id FROM fraud_flags WHERE user_id = ? AND reviewed_at IS NULL ORDER BY created_at DESC LIMIT 1
+			 ) WHERE held_by = ? AND used_by IS NULL`,
+			flag.UserID, flag.ID,
+		)
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE coupons SET held_at = NULL, held_by = NULL WHERE held_by = ? AND used_by IS NULL", flag.ID)
+	return err
+}
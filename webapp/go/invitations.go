@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 招待プログラムの設定。settings テーブルに無い項目はデフォルト値を使う
+type invitationConfig struct {
+	// 1つの招待コードを使える人数
+	MaxUses int
+	// 招待された側に付与するクーポンの割引額
+	InviteeDiscount int
+	// 招待した側に付与するクーポンの割引額
+	InviterReward int
+}
+
+var defaultInvitationConfig = invitationConfig{
+	MaxUses:         3,
+	InviteeDiscount: 1500,
+	InviterReward:   1000,
+}
+
+// 任意に設定できる招待コードの形式
+var vanityInvitationCodePattern = regexp.MustCompile(`^[0-9A-Za-z_-]{4,30}$`)
+
+func getInvitationConfig(ctx context.Context, tx *sqlx.Tx) (*invitationConfig, error) {
+	settings := []struct {
+		Name  string `db:"name"`
+		Value string `db:"value"`
+	}{}
+	if err := tx.SelectContext(ctx, &settings, "SELECT name, value FROM settings WHERE name LIKE 'invitation\\_%'"); err != nil {
+		return nil, err
+	}
+
+	config := defaultInvitationConfig
+	for _, setting := range settings {
+		var dest *int
+		switch setting.Name {
+		case "invitation_max_uses":
+			dest = &config.MaxUses
+		case "invitation_invitee_discount":
+			dest = &config.InviteeDiscount
+		case "invitation_inviter_reward":
+			dest = &config.InviterReward
+		default:
+			continue
+		}
+		v, err := strconv.Atoi(setting.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid setting %s: %w", setting.Name, err)
+		}
+		*dest = v
+	}
+	return &config, nil
+}
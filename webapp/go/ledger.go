@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+// 勘定科目
+const (
+	// 利用者に請求する額
+	ledgerAccountRiderReceivable = "rider_receivable"
+	// クーポンの割引をプラットフォームが負担した額
+	ledgerAccountCouponSubsidy = "coupon_subsidy"
+	// プラットフォームの手数料収入
+	ledgerAccountPlatformRevenue = "platform_revenue"
+	// オーナーに支払う義務がある額
+	ledgerAccountOwnerPayable = "owner_payable"
+	// オーナーへ支払った額
+	ledgerAccountCash = "cash"
+)
+
+// 支払い期間は UTC の1日とする
+const payoutPeriodLength = 24 * time.Hour
+
+// 仕訳の created_at はトランザクションのコミットより前に決まるため、
+// 期間の終わりの直前に計上した仕訳がコミットされるのを待ってから締める
+const payoutCloseGrace = 5 * time.Minute
+
+const defaultPlatformFeeRate = 20
+
+type ledgerPosting struct {
+	Account string
+	Amount  int
+}
+
+// 仕訳を1取引として記録する。借方と貸方が一致しなければエラーにする
+func postLedgerTransaction(ctx context.Context, tx *sqlx.Tx, ownerID, rideID, payoutID *string, postings []ledgerPosting) error {
+	sum := 0
+	for _, p := range postings {
+		sum += p.Amount
+	}
+	if sum != 0 {
+		return fmt.Errorf("unbalanced ledger transaction: %v", postings)
+	}
+
+	transactionID := ulid.Make().String()
+	for _, p := range postings {
+		if p.Amount == 0 {
+			continue
+		}
+		if _, err := tx.ExecContext(
+			ctx,
+			"INSERT INTO ledger_entries (id, transaction_id, account, amount, owner_id, ride_id, payout_id) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			ulid.Make().String(), transactionID, p.Account, p.Amount, ownerID, rideID, payoutID,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getPlatformFeeRate(ctx context.Context, tx *sqlx.Tx) (int, error) {
+	var value string
+	if err := tx.GetContext(ctx, &value, "SELECT value FROM settings WHERE name = 'platform_fee_rate'"); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return defaultPlatformFeeRate, nil
+		}
+		return 0, err
+	}
+	rate, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid setting platform_fee_rate: %w", err)
+	}
+	return rate, nil
+}
+
+// 完了したライドの売上を計上する
+// オーナーの取り分は割引前の運賃から手数料を引いた額とし、クーポンの割引はプラットフォームが負担する
+func postRideLedger(ctx context.Context, tx *sqlx.Tx, ride *Ride, charged int) error {
+	var ownerID string
+	if err := tx.GetContext(ctx, &ownerID, "SELECT owner_id FROM chairs WHERE id = ?", ride.ChairID); err != nil {
+		return err
+	}
+	rate, err := getPlatformFeeRate(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	fare := calculateSale(*ride)
+	fee := fare * rate / 100
+	return postLedgerTransaction(ctx, tx, &ownerID, &ride.ID, nil, []ledgerPosting{
+		{Account: ledgerAccountRiderReceivable, Amount: charged},
+		{Account: ledgerAccountCouponSubsidy, Amount: fare - charged},
+		{Account: ledgerAccountPlatformRevenue, Amount: -fee},
+		{Account: ledgerAccountOwnerPayable, Amount: -(fare - fee)},
+	})
+}
+
+// 返金した額だけライドの売上を取り消す
+// 計上したときの仕訳を返金額の割合で逆にし、端数はプラットフォームの手数料収入で調整する
+func postRefundLedger(ctx context.Context, tx *sqlx.Tx, rideID string, amount int) error {
+	entries := []struct {
+		Account string  `db:"account"`
+		Amount  int     `db:"amount"`
+		OwnerID *string `db:"owner_id"`
+	}{}
+	if err := tx.SelectContext(
+		ctx,
+		&entries,
+		`SELECT account, amount, owner_id FROM ledger_entries
+		 WHERE transaction_id = (SELECT transaction_id FROM ledger_entries WHERE ride_id = ? ORDER BY created_at, id LIMIT 1)`,
+		rideID,
+	); err != nil {
+		return err
+	}
+
+	charged := 0
+	var ownerID *string
+	for _, e := range entries {
+		if e.Account == ledgerAccountRiderReceivable {
+			charged = e.Amount
+		}
+		if e.Account == ledgerAccountOwnerPayable {
+			ownerID = e.OwnerID
+		}
+	}
+	// 売上を計上していないライドは取り消すものがない
+	if charged <= 0 {
+		return nil
+	}
+
+	postings := []ledgerPosting{{Account: ledgerAccountRiderReceivable, Amount: -amount}}
+	rest := amount
+	for _, e := range entries {
+		if e.Account == ledgerAccountRiderReceivable || e.Account == ledgerAccountPlatformRevenue {
+			continue
+		}
+		reversal := -e.Amount * amount / charged
+		postings = append(postings, ledgerPosting{Account: e.Account, Amount: reversal})
+		rest -= reversal
+	}
+	postings = append(postings, ledgerPosting{Account: ledgerAccountPlatformRevenue, Amount: rest})
+	return postLedgerTransaction(ctx, tx, ownerID, &rideID, nil, postings)
+}
+
+func payoutPeriodStart(t time.Time) time.Time {
+	return t.UTC().Truncate(payoutPeriodLength)
+}
+
+type payoutPeriodSummary struct {
+	PeriodStart   string `json:"period_start"`
+	AlreadyClosed bool   `json:"already_closed"`
+	Owners        int    `json:"owners"`
+	Amount        int    `json:"amount"`
+}
+
+// 期間を締めて、期間中に計上したオーナーの取り分を支払いとして確定する
+// 返金による取り消しは取り消した時点の期間の支払いから差し引く
+func closePayoutPeriod(ctx context.Context, periodStart time.Time) (*payoutPeriodSummary, error) {
+	periodStart = payoutPeriodStart(periodStart)
+	periodEnd := periodStart.Add(payoutPeriodLength)
+	summary := &payoutPeriodSummary{PeriodStart: periodStart.Format(time.DateOnly)}
+	if periodEnd.Add(payoutCloseGrace).After(time.Now()) {
+		return nil, fmt.Errorf("period %s has not ended yet", summary.PeriodStart)
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "INSERT IGNORE INTO payout_periods (period_start) VALUES (?)", periodStart)
+	if err != nil {
+		return nil, err
+	}
+	if count, err := result.RowsAffected(); err != nil {
+		return nil, err
+	} else if count == 0 {
+		summary.AlreadyClosed = true
+		return summary, nil
+	}
+
+	earnings := []struct {
+		OwnerID   string `db:"owner_id"`
+		Amount    int    `db:"amount"`
+		RideCount int    `db:"ride_count"`
+	}{}
+	if err := tx.SelectContext(
+		ctx,
+		&earnings,
+		`SELECT owner_id, -SUM(amount) AS amount, COUNT(DISTINCT CASE WHEN amount < 0 THEN ride_id END) AS ride_count FROM ledger_entries
+		 WHERE account = ? AND ride_id IS NOT NULL AND created_at >= ? AND created_at < ?
+		 GROUP BY owner_id`,
+		ledgerAccountOwnerPayable, periodStart, periodEnd,
+	); err != nil {
+		return nil, err
+	}
+
+	for _, e := range earnings {
+		payoutID := ulid.Make().String()
+		if _, err := tx.ExecContext(
+			ctx,
+			"INSERT INTO owner_payouts (id, owner_id, period_start, amount, ride_count) VALUES (?, ?, ?, ?, ?)",
+			payoutID, e.OwnerID, periodStart, e.Amount, e.RideCount,
+		); err != nil {
+			return nil, err
+		}
+		if err := postLedgerTransaction(ctx, tx, &e.OwnerID, nil, &payoutID, []ledgerPosting{
+			{Account: ledgerAccountOwnerPayable, Amount: e.Amount},
+			{Account: ledgerAccountCash, Amount: -e.Amount},
+		}); err != nil {
+			return nil, err
+		}
+		summary.Owners++
+		summary.Amount += e.Amount
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+// 締めていない期間のうち、終わっているものをすべて締める
+func closeDuePayoutPeriods(ctx context.Context) ([]*payoutPeriodSummary, error) {
+	var next sql.NullTime
+	if err := db.GetContext(ctx, &next, "SELECT MAX(period_start) + INTERVAL 1 DAY FROM payout_periods"); err != nil {
+		return nil, err
+	}
+	if !next.Valid {
+		if err := db.GetContext(ctx, &next, "SELECT MIN(created_at) FROM ledger_entries"); err != nil {
+			return nil, err
+		}
+	}
+	summaries := []*payoutPeriodSummary{}
+	if !next.Valid {
+		return summaries, nil
+	}
+
+	current := payoutPeriodStart(time.Now().Add(-payoutCloseGrace))
+	for start := payoutPeriodStart(next.Time); start.Before(current); start = start.Add(payoutPeriodLength) {
+		summary, err := closePayoutPeriod(ctx, start)
+		if err != nil {
+			return summaries, err
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries, nil
+}
+
+// ISUCON_PAYOUT_CLOSE_INTERVAL (例: 1h) が設定されていれば定期的に期間を締める
+func runPayoutCloseJob(ctx context.Context) {
+	v := os.Getenv("ISUCON_PAYOUT_CLOSE_INTERVAL")
+	if v == "" {
+		return
+	}
+	interval, err := time.ParseDuration(v)
+	if err != nil || interval <= 0 {
+		slog.Error("invalid ISUCON_PAYOUT_CLOSE_INTERVAL", slog.String("value", v))
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		summaries, err := closeDuePayoutPeriods(ctx)
+		if err != nil {
+			slog.Error("failed to close payout periods", slog.Any("error", err))
+		}
+		for _, summary := range summaries {
+			slog.Info("payout period closed",
+				slog.String("period_start", summary.PeriodStart),
+				slog.Int("owners", summary.Owners),
+				slog.Int("amount", summary.Amount),
+			)
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	crand "crypto/rand"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
@@ -37,7 +39,22 @@ func main() {
 	// 	http.ListenAndServe(":6061", r)
 	// }()
 
+	// サブコマンドが指定されたらサーバーを起動せずにそれを実行する
+	if len(os.Args) > 1 {
+		setupDB()
+		setupPaymentGateway()
+		if err := runCommand(context.Background(), os.Args[1], os.Args[2:]); err != nil {
+			slog.Error("command failed", slog.String("command", os.Args[1]), slog.Any("error", err))
+			os.Exit(1)
+		}
+		return
+	}
+
 	mux := setup()
+	go runPaymentWorker(context.Background())
+	go runReconciliationJob(context.Background())
+	go runPayoutCloseJob(context.Background())
+	go runStaleChairJob(context.Background())
 	slog.Info("Listening on :8080")
 	http.ListenAndServe(":8080", mux)
 	// go func() {
@@ -48,45 +65,8 @@ func main() {
 }
 
 func setup() http.Handler {
-	host := os.Getenv("ISUCON_DB_HOST")
-	if host == "" {
-		host = "127.0.0.1"
-	}
-	port := os.Getenv("ISUCON_DB_PORT")
-	if port == "" {
-		port = "3306"
-	}
-	_, err := strconv.Atoi(port)
-	if err != nil {
-		panic(fmt.Sprintf("failed to convert DB port number from ISUCON_DB_PORT environment variable into int: %v", err))
-	}
-	user := os.Getenv("ISUCON_DB_USER")
-	if user == "" {
-		user = "isucon"
-	}
-	password := os.Getenv("ISUCON_DB_PASSWORD")
-	if password == "" {
-		password = "isucon"
-	}
-	dbname := os.Getenv("ISUCON_DB_NAME")
-	if dbname == "" {
-		dbname = "isuride"
-	}
-
-	dbConfig := mysql.NewConfig()
-	dbConfig.User = user
-	dbConfig.Passwd = password
-	dbConfig.Addr = net.JoinHostPort(host, port)
-	dbConfig.Net = "tcp"
-	dbConfig.DBName = dbname
-	dbConfig.ParseTime = true
-	dbConfig.InterpolateParams = true
-
-	_db, err := sqlx.Connect("mysql", dbConfig.FormatDSN())
-	if err != nil {
-		panic(err)
-	}
-	db = _db
+	setupDB()
+	setupPaymentGateway()
 
 	mux := chi.NewRouter()
 	mux.Use(middleware.Logger)
@@ -99,6 +79,11 @@ func setup() http.Handler {
 
 		authedMux := mux.With(appAuthMiddleware)
 		authedMux.HandleFunc("POST /api/app/payment-methods", appPostPaymentMethods)
+		authedMux.HandleFunc("GET /api/app/payment-methods", appGetPaymentMethods)
+		authedMux.HandleFunc("DELETE /api/app/payment-methods/{payment_method_id}", appDeletePaymentMethod)
+		authedMux.HandleFunc("POST /api/app/payment-methods/{payment_method_id}/default", appPostDefaultPaymentMethod)
+		authedMux.HandleFunc("POST /api/app/invitation-code", appPostInvitationCode)
+		authedMux.HandleFunc("GET /api/app/referrals", appGetReferrals)
 		authedMux.HandleFunc("GET /api/app/rides", appGetRides)
 		authedMux.HandleFunc("POST /api/app/rides", appPostRides)
 		authedMux.HandleFunc("POST /api/app/rides/estimated-fare", appPostRidesEstimatedFare)
@@ -113,7 +98,27 @@ func setup() http.Handler {
 
 		authedMux := mux.With(ownerAuthMiddleware)
 		authedMux.HandleFunc("GET /api/owner/sales", ownerGetSales)
+		authedMux.HandleFunc("GET /api/owner/sales/export", ownerGetSalesExport)
+		authedMux.HandleFunc("GET /api/owner/payouts", ownerGetPayouts)
+		authedMux.HandleFunc("GET /api/owner/payouts/{period_start}", ownerGetPayoutStatement)
 		authedMux.HandleFunc("GET /api/owner/chairs", ownerGetChairs)
+		authedMux.HandleFunc("GET /api/owner/utilization", ownerGetUtilization)
+		authedMux.HandleFunc("GET /api/owner/fleet", ownerGetFleet)
+		authedMux.HandleFunc("GET /api/owner/fleet/stream", ownerGetFleetStream)
+		authedMux.HandleFunc("GET /api/owner/chairs/{chair_id}", ownerGetChairDetail)
+		authedMux.HandleFunc("PATCH /api/owner/chairs/{chair_id}", ownerPatchChair)
+		authedMux.HandleFunc("GET /api/owner/chairs/{chair_id}/activities", ownerGetChairActivities)
+		authedMux.HandleFunc("POST /api/owner/chairs/{chair_id}/suspend", ownerPostChairSuspend)
+		authedMux.HandleFunc("POST /api/owner/chairs/{chair_id}/resume", ownerPostChairResume)
+		authedMux.HandleFunc("POST /api/owner/chairs/{chair_id}/retire", ownerPostChairRetire)
+		authedMux.HandleFunc("POST /api/owner/chairs/{chair_id}/access-token", ownerPostChairAccessToken)
+		authedMux.HandleFunc("POST /api/owner/chair-register-token", ownerPostChairRegisterToken)
+		authedMux.HandleFunc("GET /api/owner/chair-register-tokens", ownerGetChairRegisterTokens)
+		authedMux.HandleFunc("POST /api/owner/chair-register-tokens", ownerPostChairRegisterTokens)
+		authedMux.HandleFunc("DELETE /api/owner/chair-register-tokens/{token_id}", ownerDeleteChairRegisterToken)
+		authedMux.HandleFunc("GET /api/owner/chair-registrations", ownerGetChairRegistrations)
+		authedMux.HandleFunc("GET /api/owner/notifications", ownerGetNotifications)
+		authedMux.HandleFunc("POST /api/owner/notifications/{notification_id}/read", ownerPostNotificationRead)
 	}
 
 	// chair handlers
@@ -130,11 +135,66 @@ func setup() http.Handler {
 	// internal handlers
 	{
 		mux.HandleFunc("GET /api/internal/matching", internalGetMatching)
+		mux.HandleFunc("GET /api/internal/metrics", internalGetMetrics)
+	}
+
+	// admin handlers
+	{
+		authedMux := mux.With(adminAuthMiddleware)
+		authedMux.HandleFunc("GET /api/admin/referrals", adminGetReferralTree)
+		authedMux.HandleFunc("GET /api/admin/fraud-flags", adminGetFraudFlags)
+		authedMux.HandleFunc("POST /api/admin/fraud-flags/{flag_id}/review", adminPostFraudFlagReview)
+		authedMux.HandleFunc("GET /api/admin/ride-support-flags", adminGetRideSupportFlags)
+		authedMux.HandleFunc("POST /api/admin/ride-support-flags/{flag_id}/resolve", adminPostRideSupportFlagResolve)
+		authedMux.HandleFunc("POST /api/admin/reconciliation", adminPostReconciliation)
+		authedMux.HandleFunc("POST /api/admin/rides/{ride_id}/refunds", adminPostRideRefund)
 	}
 
 	return mux
 }
 
+func setupDB() {
+	host := os.Getenv("ISUCON_DB_HOST")
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	port := os.Getenv("ISUCON_DB_PORT")
+	if port == "" {
+		port = "3306"
+	}
+	_, err := strconv.Atoi(port)
+	if err != nil {
+		panic(fmt.Sprintf("failed to convert DB port number from ISUCON_DB_PORT environment variable into int: %v", err))
+	}
+	user := os.Getenv("ISUCON_DB_USER")
+	if user == "" {
+		user = "isucon"
+	}
+	password := os.Getenv("ISUCON_DB_PASSWORD")
+	if password == "" {
+		password = "isucon"
+	}
+	dbname := os.Getenv("ISUCON_DB_NAME")
+	if dbname == "" {
+		dbname = "isuride"
+	}
+
+	dbConfig := mysql.NewConfig()
+	dbConfig.User = user
+	dbConfig.Passwd = password
+	dbConfig.Addr = net.JoinHostPort(host, port)
+	dbConfig.Net = "tcp"
+	dbConfig.DBName = dbname
+	dbConfig.ParseTime = true
+	dbConfig.InterpolateParams = true
+
+	_db, err := sqlx.Connect("mysql", dbConfig.FormatDSN())
+	if err != nil {
+		panic(err)
+	}
+	db = _db
+}
+
 type postInitializeRequest struct {
 	PaymentServer string `json:"payment_server"`
 }
@@ -195,7 +255,13 @@ func writeError(w http.ResponseWriter, statusCode int, err error) {
 	}
 	w.Write(buf)
 
-	slog.Error("error response wrote", err)
+	slog.Error("error response wrote", slog.Any("error", err))
+}
+
+// 一意制約に違反したときのエラーかどうか
+func isDuplicateEntryError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062
 }
 
 func secureRandomStr(b int) string {
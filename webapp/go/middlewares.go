@@ -167,3 +167,10 @@ func cacheSetChair(accessToken string, chair *Chair, duration time.Duration) {
 		Expiration: int32(duration.Seconds()),
 	})
 }
+
+// 椅子の情報を変更したときや、アクセストークンを無効にしたときにキャッシュを消す
+func cacheDeleteChair(accessToken string) {
+	if err := memcachedClient.Delete(accessToken); err != nil && !errors.Is(err, memcache.ErrCacheMiss) {
+		slog.Error("failed to delete cache item", slog.Any("error", err))
+	}
+}
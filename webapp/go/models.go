@@ -6,14 +6,16 @@ import (
 )
 
 type Chair struct {
-	ID          string    `db:"id"`
-	OwnerID     string    `db:"owner_id"`
-	Name        string    `db:"name"`
-	Model       string    `db:"model"`
-	IsActive    bool      `db:"is_active"`
-	AccessToken string    `db:"access_token"`
-	CreatedAt   time.Time `db:"created_at"`
-	UpdatedAt   time.Time `db:"updated_at"`
+	ID          string     `db:"id"`
+	OwnerID     string     `db:"owner_id"`
+	Name        string     `db:"name"`
+	Model       string     `db:"model"`
+	IsActive    bool       `db:"is_active"`
+	AccessToken string     `db:"access_token"`
+	CreatedAt   time.Time  `db:"created_at"`
+	UpdatedAt   time.Time  `db:"updated_at"`
+	SuspendedAt *time.Time `db:"suspended_at"`
+	RetiredAt   *time.Time `db:"retired_at"`
 }
 
 type ChairModel struct {
@@ -42,9 +44,13 @@ type User struct {
 }
 
 type PaymentToken struct {
-	UserID    string    `db:"user_id"`
-	Token     string    `db:"token"`
-	CreatedAt time.Time `db:"created_at"`
+	ID        string     `db:"id"`
+	UserID    string     `db:"user_id"`
+	Token     string     `db:"token"`
+	Label     string     `db:"label"`
+	IsDefault bool       `db:"is_default"`
+	CreatedAt time.Time  `db:"created_at"`
+	DeletedAt *time.Time `db:"deleted_at"`
 }
 
 type Ride struct {
@@ -58,6 +64,8 @@ type Ride struct {
 	Evaluation           *int           `db:"evaluation"`
 	CreatedAt            time.Time      `db:"created_at"`
 	UpdatedAt            time.Time      `db:"updated_at"`
+	PaymentTokenID       sql.NullString `db:"payment_token_id"`
+	MatchedAt            *time.Time     `db:"matched_at"`
 }
 
 type RideStatus struct {
@@ -79,9 +87,146 @@ type Owner struct {
 }
 
 type Coupon struct {
-	UserID    string    `db:"user_id"`
-	Code      string    `db:"code"`
-	Discount  int       `db:"discount"`
+	UserID      string     `db:"user_id"`
+	Code        string     `db:"code"`
+	Discount    int        `db:"discount"`
+	CreatedAt   time.Time  `db:"created_at"`
+	UsedBy      *string    `db:"used_by"`
+	Type        string     `db:"type"`
+	MaxDiscount *int       `db:"max_discount"`
+	MinFare     int        `db:"min_fare"`
+	ExpiresAt   *time.Time `db:"expires_at"`
+	HeldAt      *time.Time `db:"held_at"`
+	HeldBy      *string    `db:"held_by"`
+}
+
+type Invitation struct {
+	InviteeID        string    `db:"invitee_id"`
+	InviterID        string    `db:"inviter_id"`
+	InvitationCode   string    `db:"invitation_code"`
+	RewardCouponCode *string   `db:"reward_coupon_code"`
+	CreatedAt        time.Time `db:"created_at"`
+}
+
+type FraudFlag struct {
+	ID         string     `db:"id"`
+	UserID     string     `db:"user_id"`
+	Reason     string     `db:"reason"`
+	Score      int        `db:"score"`
+	Detail     string     `db:"detail"`
+	CreatedAt  time.Time  `db:"created_at"`
+	ReviewedAt *time.Time `db:"reviewed_at"`
+	Resolution *string    `db:"resolution"`
+}
+
+type Payment struct {
+	ID            string    `db:"id"`
+	RideID        string    `db:"ride_id"`
+	UserID        string    `db:"user_id"`
+	Token         string    `db:"token"`
+	Amount        int       `db:"amount"`
+	Status        string    `db:"status"`
+	Attempts      int       `db:"attempts"`
+	LastError     *string   `db:"last_error"`
+	NextAttemptAt time.Time `db:"next_attempt_at"`
+	CreatedAt     time.Time `db:"created_at"`
+	UpdatedAt     time.Time `db:"updated_at"`
+}
+
+type Refund struct {
+	ID            string    `db:"id"`
+	PaymentID     string    `db:"payment_id"`
+	RideID        string    `db:"ride_id"`
+	Amount        int       `db:"amount"`
+	Reason        string    `db:"reason"`
+	Status        string    `db:"status"`
+	Attempts      int       `db:"attempts"`
+	LastError     *string   `db:"last_error"`
+	NextAttemptAt time.Time `db:"next_attempt_at"`
+	CreatedAt     time.Time `db:"created_at"`
+	UpdatedAt     time.Time `db:"updated_at"`
+}
+
+type LedgerEntry struct {
+	ID            string    `db:"id"`
+	TransactionID string    `db:"transaction_id"`
+	Account       string    `db:"account"`
+	Amount        int       `db:"amount"`
+	OwnerID       *string   `db:"owner_id"`
+	RideID        *string   `db:"ride_id"`
+	PayoutID      *string   `db:"payout_id"`
+	CreatedAt     time.Time `db:"created_at"`
+}
+
+type OwnerPayout struct {
+	ID          string    `db:"id"`
+	OwnerID     string    `db:"owner_id"`
+	PeriodStart time.Time `db:"period_start"`
+	Amount      int       `db:"amount"`
+	RideCount   int       `db:"ride_count"`
+	CreatedAt   time.Time `db:"created_at"`
+}
+
+type RideSale struct {
+	RideID      string    `db:"ride_id"`
+	OwnerID     string    `db:"owner_id"`
+	ChairID     string    `db:"chair_id"`
+	Fare        int       `db:"fare"`
+	Discount    int       `db:"discount"`
+	Charged     int       `db:"charged"`
+	CompletedAt time.Time `db:"completed_at"`
+}
+
+type ChairRegisterToken struct {
+	ID              string     `db:"id"`
+	OwnerID         string     `db:"owner_id"`
+	Token           string     `db:"token"`
+	MaxChairs       *int       `db:"max_chairs"`
+	RegisteredCount int        `db:"registered_count"`
+	Model           *string    `db:"model"`
+	ExpiresAt       *time.Time `db:"expires_at"`
+	RevokedAt       *time.Time `db:"revoked_at"`
+	CreatedAt       time.Time  `db:"created_at"`
+}
+
+type ChairRegistration struct {
+	ID              string    `db:"id"`
+	OwnerID         *string   `db:"owner_id"`
+	RegisterTokenID *string   `db:"register_token_id"`
+	ChairID         *string   `db:"chair_id"`
+	Name            string    `db:"name"`
+	Model           string    `db:"model"`
+	Result          string    `db:"result"`
+	Reason          *string   `db:"reason"`
+	RemoteAddr      string    `db:"remote_addr"`
+	UserAgent       string    `db:"user_agent"`
+	CreatedAt       time.Time `db:"created_at"`
+}
+
+type ChairActivity struct {
+	ID        int64     `db:"id"`
+	ChairID   string    `db:"chair_id"`
+	IsActive  bool      `db:"is_active"`
+	Reason    string    `db:"reason"`
 	CreatedAt time.Time `db:"created_at"`
-	UsedBy    *string   `db:"used_by"`
+}
+
+type OwnerNotification struct {
+	ID        string     `db:"id"`
+	OwnerID   string     `db:"owner_id"`
+	ChairID   *string    `db:"chair_id"`
+	Type      string     `db:"type"`
+	Message   string     `db:"message"`
+	CreatedAt time.Time  `db:"created_at"`
+	ReadAt    *time.Time `db:"read_at"`
+}
+
+type RideSupportFlag struct {
+	ID         string     `db:"id"`
+	RideID     string     `db:"ride_id"`
+	ChairID    string     `db:"chair_id"`
+	Reason     string     `db:"reason"`
+	Detail     string     `db:"detail"`
+	CreatedAt  time.Time  `db:"created_at"`
+	ResolvedAt *time.Time `db:"resolved_at"`
 }
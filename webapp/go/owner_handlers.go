@@ -1,12 +1,20 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/base64"
+	"encoding/csv"
 	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"slices"
 	"strconv"
 	"time"
 
+	"github.com/goccy/go-json"
+	"github.com/jmoiron/sqlx"
 	"github.com/oklog/ulid/v2"
 )
 
@@ -63,41 +71,67 @@ func ownerPostOwners(w http.ResponseWriter, r *http.Request) {
 }
 
 type chairSales struct {
-	ID    string `json:"id"`
-	Name  string `json:"name"`
-	Sales int    `json:"sales"`
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Sales    int    `json:"sales"`
+	Discount int    `json:"discount"`
+	Refund   int    `json:"refund"`
 }
 
 type modelSales struct {
-	Model string `json:"model"`
-	Sales int    `json:"sales"`
+	Model    string `json:"model"`
+	Sales    int    `json:"sales"`
+	Discount int    `json:"discount"`
+	Refund   int    `json:"refund"`
 }
 
 type ownerGetSalesResponse struct {
-	TotalSales int          `json:"total_sales"`
-	Chairs     []chairSales `json:"chairs"`
-	Models     []modelSales `json:"models"`
+	TotalSales    int          `json:"total_sales"`
+	TotalDiscount int          `json:"total_discount"`
+	TotalRefund   int          `json:"total_refund"`
+	Chairs        []chairSales `json:"chairs"`
+	Models        []modelSales `json:"models"`
+	// granularity を指定したときのみ返す
+	Series []salesBucket `json:"series,omitempty"`
 }
 
-func ownerGetSales(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
+// since, until (UnixMilli) で指定された期間を取得する
+func parseSalesPeriod(r *http.Request) (time.Time, time.Time, error) {
 	since := time.Unix(0, 0)
 	until := time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
 	if r.URL.Query().Get("since") != "" {
 		parsed, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
 		if err != nil {
-			writeError(w, http.StatusBadRequest, err)
-			return
+			return time.Time{}, time.Time{}, err
 		}
 		since = time.UnixMilli(parsed)
 	}
 	if r.URL.Query().Get("until") != "" {
 		parsed, err := strconv.ParseInt(r.URL.Query().Get("until"), 10, 64)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		until = time.UnixMilli(parsed)
+	}
+	return since, until, nil
+}
+
+func ownerGetSales(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	since, until, err := parseSalesPeriod(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// granularity (hour/day/week/month) を指定すると timezone (例: Asia/Tokyo) の暦で区切った時系列も返す
+	var series *salesSeriesBuilder
+	if granularity := r.URL.Query().Get("granularity"); granularity != "" {
+		series, err = newSalesSeriesBuilder(granularity, r.URL.Query().Get("timezone"))
 		if err != nil {
 			writeError(w, http.StatusBadRequest, err)
 			return
 		}
-		until = time.UnixMilli(parsed)
 	}
 
 	owner := r.Context().Value("owner").(*Owner)
@@ -115,69 +149,174 @@ func ownerGetSales(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 完了時に ride_sales に記録した売上を椅子ごとに集計する
+	aggregates := []struct {
+		ChairID  string `db:"chair_id"`
+		Sales    int    `db:"sales"`
+		Discount int    `db:"discount"`
+	}{}
+	if err := tx.SelectContext(
+		ctx,
+		&aggregates,
+		"SELECT chair_id, SUM(fare) AS sales, SUM(discount) AS discount FROM ride_sales WHERE owner_id = ? AND completed_at BETWEEN ? AND ? + INTERVAL 999 MICROSECOND GROUP BY chair_id",
+		owner.ID, since, until,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	salesByChairID := make(map[string]int, len(aggregates))
+	discountByChairID := make(map[string]int, len(aggregates))
+	for _, a := range aggregates {
+		salesByChairID[a.ChairID] = a.Sales
+		discountByChairID[a.ChairID] = a.Discount
+	}
+
+	// 返金は返金した日時の期間に計上する
+	refunds := []struct {
+		ChairID string `db:"chair_id"`
+		Amount  int    `db:"amount"`
+	}{}
+	if err := tx.SelectContext(
+		ctx,
+		&refunds,
+		`SELECT rides.chair_id, SUM(refunds.amount) AS amount FROM refunds
+		 JOIN rides ON rides.id = refunds.ride_id JOIN chairs ON chairs.id = rides.chair_id
+		 WHERE chairs.owner_id = ? AND refunds.status = 'succeeded' AND refunds.created_at BETWEEN ? AND ? + INTERVAL 999 MICROSECOND
+		 GROUP BY rides.chair_id`,
+		owner.ID, since, until,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	refundByChairID := make(map[string]int, len(refunds))
+	for _, refund := range refunds {
+		refundByChairID[refund.ChairID] = refund.Amount
+	}
+
 	res := ownerGetSalesResponse{
 		TotalSales: 0,
 	}
 
 	modelSalesByModel := map[string]int{}
+	modelDiscountByModel := map[string]int{}
+	modelRefundByModel := map[string]int{}
 	for _, chair := range chairs {
-		rides := []Ride{}
-		if err := tx.SelectContext(ctx, &rides, "SELECT rides.* FROM rides JOIN ride_statuses ON rides.id = ride_statuses.ride_id WHERE chair_id = ? AND status = 'COMPLETED' AND updated_at BETWEEN ? AND ? + INTERVAL 999 MICROSECOND", chair.ID, since, until); err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-
-		sales := sumSales(rides)
+		sales := salesByChairID[chair.ID]
+		discount := discountByChairID[chair.ID]
+		refund := refundByChairID[chair.ID]
 		res.TotalSales += sales
+		res.TotalDiscount += discount
+		res.TotalRefund += refund
 
 		res.Chairs = append(res.Chairs, chairSales{
-			ID:    chair.ID,
-			Name:  chair.Name,
-			Sales: sales,
+			ID:       chair.ID,
+			Name:     chair.Name,
+			Sales:    sales,
+			Discount: discount,
+			Refund:   refund,
 		})
 
 		modelSalesByModel[chair.Model] += sales
+		modelDiscountByModel[chair.Model] += discount
+		modelRefundByModel[chair.Model] += refund
 	}
 
 	models := []modelSales{}
 	for model, sales := range modelSalesByModel {
 		models = append(models, modelSales{
-			Model: model,
-			Sales: sales,
+			Model:    model,
+			Sales:    sales,
+			Discount: modelDiscountByModel[model],
+			Refund:   modelRefundByModel[model],
 		})
 	}
 	res.Models = models
 
-	writeJSON(w, http.StatusOK, res)
-}
-
-func sumSales(rides []Ride) int {
-	sale := 0
-	for _, ride := range rides {
-		sale += calculateSale(ride)
+	if series != nil {
+		chairByID := make(map[string]*Chair, len(chairs))
+		for i := range chairs {
+			chairByID[chairs[i].ID] = &chairs[i]
+		}
+		rideSales := []RideSale{}
+		if err := tx.SelectContext(
+			ctx,
+			&rideSales,
+			"SELECT * FROM ride_sales WHERE owner_id = ? AND completed_at BETWEEN ? AND ? + INTERVAL 999 MICROSECOND",
+			owner.ID, since, until,
+		); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		for _, rideSale := range rideSales {
+			if chair, ok := chairByID[rideSale.ChairID]; ok {
+				series.add(chair, rideSale.CompletedAt, rideSale.Fare)
+			}
+		}
+		refundsAt := []struct {
+			ChairID   string    `db:"chair_id"`
+			Amount    int       `db:"amount"`
+			CreatedAt time.Time `db:"created_at"`
+		}{}
+		if err := tx.SelectContext(
+			ctx,
+			&refundsAt,
+			`SELECT rides.chair_id, refunds.amount, refunds.created_at FROM refunds
+			 JOIN rides ON rides.id = refunds.ride_id JOIN chairs ON chairs.id = rides.chair_id
+			 WHERE chairs.owner_id = ? AND refunds.status = 'succeeded' AND refunds.created_at BETWEEN ? AND ? + INTERVAL 999 MICROSECOND`,
+			owner.ID, since, until,
+		); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		for _, refund := range refundsAt {
+			if chair, ok := chairByID[refund.ChairID]; ok {
+				series.addRefund(chair, refund.CreatedAt, refund.Amount)
+			}
+		}
+		res.Series = series.build()
 	}
-	return sale
+
+	writeJSON(w, http.StatusOK, res)
 }
 
 func calculateSale(ride Ride) int {
 	return calculateFare(ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
 }
 
+// 完了したライドの売上を記録する
+// charged はクーポン適用後に実際に請求した額
+func recordRideSale(ctx context.Context, tx *sqlx.Tx, ride *Ride, charged int) error {
+	fare := calculateSale(*ride)
+	_, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO ride_sales (ride_id, owner_id, chair_id, fare, discount, charged, completed_at)
+		 SELECT ?, owner_id, id, ?, ?, ?, ? FROM chairs WHERE id = ?`,
+		ride.ID, fare, fare-charged, charged, ride.UpdatedAt, ride.ChairID,
+	)
+	return err
+}
+
 type chairWithDetail struct {
-	ID                     string       `db:"id"`
-	OwnerID                string       `db:"owner_id"`
-	Name                   string       `db:"name"`
-	AccessToken            string       `db:"access_token"`
-	Model                  string       `db:"model"`
-	IsActive               bool         `db:"is_active"`
-	CreatedAt              time.Time    `db:"created_at"`
-	UpdatedAt              time.Time    `db:"updated_at"`
-	TotalDistance          int          `db:"total_distance"`
-	TotalDistanceUpdatedAt sql.NullTime `db:"total_distance_updated_at"`
+	ID                     string         `db:"id"`
+	OwnerID                string         `db:"owner_id"`
+	Name                   string         `db:"name"`
+	AccessToken            string         `db:"access_token"`
+	Model                  string         `db:"model"`
+	IsActive               bool           `db:"is_active"`
+	CreatedAt              time.Time      `db:"created_at"`
+	UpdatedAt              time.Time      `db:"updated_at"`
+	SuspendedAt            sql.NullTime   `db:"suspended_at"`
+	RetiredAt              sql.NullTime   `db:"retired_at"`
+	TotalDistance          int            `db:"total_distance"`
+	TotalDistanceUpdatedAt sql.NullTime   `db:"total_distance_updated_at"`
+	Sales                  int            `db:"sales"`
+	RideStatus             sql.NullString `db:"ride_status"`
 }
 
 type ownerGetChairResponse struct {
 	Chairs []ownerGetChairResponseChair `json:"chairs"`
+	// 次のページを取得するときに cursor に指定する。最後のページなら含まない
+	NextCursor *string `json:"next_cursor,omitempty"`
 }
 
 type ownerGetChairResponseChair struct {
@@ -185,18 +324,112 @@ type ownerGetChairResponseChair struct {
 	Name                   string `json:"name"`
 	Model                  string `json:"model"`
 	Active                 bool   `json:"active"`
+	Suspended              bool   `json:"suspended"`
+	RetiredAt              *int64 `json:"retired_at,omitempty"`
 	RegisteredAt           int64  `json:"registered_at"`
 	TotalDistance          int    `json:"total_distance"`
 	TotalDistanceUpdatedAt *int64 `json:"total_distance_updated_at,omitempty"`
+	Sales                  int    `json:"sales"`
+	// 走行中のライドの状態。走行中でなければ含まない
+	CurrentRideStatus *string `json:"current_ride_status,omitempty"`
+}
+
+// 椅子一覧の並び順に使える項目と、対応する列
+var ownerChairSortColumns = map[string]string{
+	"name":           "name",
+	"registered_at":  "created_at",
+	"total_distance": "total_distance",
+	"sales":          "sales",
+}
+
+// 走行中のライドの状態として絞り込める値
+var ownerChairRideStatuses = []string{"MATCHING", "ENROUTE", "PICKUP", "CARRYING", "ARRIVED"}
+
+// 椅子一覧のページの続きを示すカーソル。並び順の項目の値と、同じ値の椅子を区別する ID を持つ
+type ownerChairCursor struct {
+	Value string `json:"v"`
+	ID    string `json:"id"`
+}
+
+func (c *ownerChairCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeOwnerChairCursor(s string) (*ownerChairCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	c := &ownerChairCursor{}
+	if err := json.Unmarshal(b, c); err != nil || c.ID == "" {
+		return nil, errors.New("invalid cursor")
+	}
+	return c, nil
+}
+
+func ownerChairSortValue(chair *chairWithDetail, sort string) string {
+	switch sort {
+	case "name":
+		return chair.Name
+	case "total_distance":
+		return strconv.Itoa(chair.TotalDistance)
+	case "sales":
+		return strconv.Itoa(chair.Sales)
+	default:
+		return chair.CreatedAt.UTC().Format("2006-01-02 15:04:05.999999")
+	}
 }
 
+// オーナーの椅子一覧を返す
+// sort (name, registered_at, total_distance, sales) と order (asc, desc) で並び替え、
+// model, active (true, false), ride_status (ライドの状態か none) で絞り込める
+// limit を指定すると limit (最大 1000) 件ずつ返し、cursor に前のページの next_cursor を指定すると続きを返す
 func ownerGetChairs(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	owner := ctx.Value("owner").(*Owner)
+	q := r.URL.Query()
+
+	sort := q.Get("sort")
+	if sort == "" {
+		sort = "registered_at"
+	}
+	sortColumn, ok := ownerChairSortColumns[sort]
+	if !ok {
+		writeError(w, http.StatusBadRequest, errors.New("sort must be one of name, registered_at, total_distance, sales"))
+		return
+	}
+	order := q.Get("order")
+	if order == "" {
+		order = "asc"
+	}
+	if order != "asc" && order != "desc" {
+		writeError(w, http.StatusBadRequest, errors.New("order must be asc or desc"))
+		return
+	}
+
+	limit := 0
+	if v := q.Get("limit"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed <= 0 || parsed > 1000 {
+			writeError(w, http.StatusBadRequest, errors.New("limit must be between 1 and 1000"))
+			return
+		}
+		limit = parsed
+	}
+	var cursor *ownerChairCursor
+	if v := q.Get("cursor"); v != "" {
+		c, err := decodeOwnerChairCursor(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		cursor = c
+	}
 
 	chairs := []chairWithDetail{}
 	query := `
-WITH owner_chairs AS (
+SELECT * FROM (
 SELECT
     c.id,
     c.owner_id,
@@ -205,61 +438,1266 @@ SELECT
     c.model,
     c.is_active,
     c.created_at,
-    c.updated_at
+    c.updated_at,
+    c.suspended_at,
+    c.retired_at,
+    IFNULL(cd.total_distance, 0) AS total_distance,
+    cd.updated_at AS total_distance_updated_at,
+    IFNULL(s.sales, 0) AS sales,
+    (SELECT rs.status FROM rides r JOIN ride_statuses rs ON rs.ride_id = r.id WHERE r.chair_id = c.id ORDER BY rs.created_at DESC LIMIT 1) AS ride_status
 FROM chairs c
+LEFT JOIN chair_distances cd ON cd.chair_id = c.id
+LEFT JOIN (SELECT chair_id, SUM(fare) AS sales FROM ride_sales WHERE owner_id = ? GROUP BY chair_id) s ON s.chair_id = c.id
 WHERE c.owner_id = ?
-),
-distances AS (
-    SELECT
-        chair_id,
-        cl.created_at,
-        ABS(latitude - LAG(latitude) OVER (PARTITION BY chair_id ORDER BY created_at)) +
-        ABS(longitude - LAG(longitude) OVER (PARTITION BY chair_id ORDER BY created_at)) AS distance
-    FROM chair_locations cl
-	JOIN owner_chairs oc ON oc.id = cl.chair_id
-),
-distance_summary AS (
-    SELECT
-        chair_id,
-        SUM(IFNULL(distance, 0)) AS total_distance,
-        MAX(created_at) AS total_distance_updated_at
-    FROM distances
-    GROUP BY chair_id
-)
-SELECT
-    c.id,
-    c.owner_id,
-    c.name,
-    c.access_token,
-    c.model,
-    c.is_active,
-    c.created_at,
-    c.updated_at,
-    IFNULL(ds.total_distance, 0) AS total_distance,
-    ds.total_distance_updated_at
-FROM owner_chairs c
-LEFT JOIN distance_summary ds ON ds.chair_id = c.id
-`
-	if err := db.SelectContext(ctx, &chairs, query, owner.ID); err != nil {
+) t
+WHERE 1 = 1`
+	args := []any{owner.ID, owner.ID}
+
+	if model := q.Get("model"); model != "" {
+		query += " AND model = ?"
+		args = append(args, model)
+	}
+	if active := q.Get("active"); active != "" {
+		isActive, err := strconv.ParseBool(active)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errors.New("active must be true or false"))
+			return
+		}
+		query += " AND is_active = ?"
+		args = append(args, isActive)
+	}
+	if rideStatus := q.Get("ride_status"); rideStatus != "" {
+		// 最後のライドが完了していれば走行中のライドはない
+		if rideStatus == "none" {
+			query += " AND (ride_status IS NULL OR ride_status = 'COMPLETED')"
+		} else if !slices.Contains(ownerChairRideStatuses, rideStatus) {
+			writeError(w, http.StatusBadRequest, errors.New("ride_status must be a ride status or none"))
+			return
+		} else {
+			query += " AND ride_status = ?"
+			args = append(args, rideStatus)
+		}
+	}
+
+	comparison, direction := ">", "ASC"
+	if order == "desc" {
+		comparison, direction = "<", "DESC"
+	}
+	if cursor != nil {
+		query += fmt.Sprintf(" AND (%[1]s %[2]s ? OR (%[1]s = ? AND id %[2]s ?))", sortColumn, comparison)
+		args = append(args, cursor.Value, cursor.Value, cursor.ID)
+	}
+	query += fmt.Sprintf(" ORDER BY %[1]s %[2]s, id %[2]s", sortColumn, direction)
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit+1)
+	}
+	if err := db.SelectContext(ctx, &chairs, query, args...); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	res := ownerGetChairResponse{}
+	res := ownerGetChairResponse{Chairs: []ownerGetChairResponseChair{}}
+	if limit > 0 && len(chairs) > limit {
+		chairs = chairs[:limit]
+		last := &chairs[limit-1]
+		nextCursor := (&ownerChairCursor{Value: ownerChairSortValue(last, sort), ID: last.ID}).encode()
+		res.NextCursor = &nextCursor
+	}
 	for _, chair := range chairs {
 		c := ownerGetChairResponseChair{
 			ID:            chair.ID,
 			Name:          chair.Name,
 			Model:         chair.Model,
 			Active:        chair.IsActive,
+			Suspended:     chair.SuspendedAt.Valid,
 			RegisteredAt:  chair.CreatedAt.UnixMilli(),
 			TotalDistance: chair.TotalDistance,
+			Sales:         chair.Sales,
+		}
+		if chair.RetiredAt.Valid {
+			t := chair.RetiredAt.Time.UnixMilli()
+			c.RetiredAt = &t
 		}
 		if chair.TotalDistanceUpdatedAt.Valid {
 			t := chair.TotalDistanceUpdatedAt.Time.UnixMilli()
 			c.TotalDistanceUpdatedAt = &t
 		}
+		if chair.RideStatus.Valid && chair.RideStatus.String != "COMPLETED" {
+			c.CurrentRideStatus = &chair.RideStatus.String
+		}
 		res.Chairs = append(res.Chairs, c)
 	}
 	writeJSON(w, http.StatusOK, res)
 }
+
+type ownerGetPayoutsResponse struct {
+	// まだ支払いが確定していないオーナーの取り分
+	UnpaidBalance int                           `json:"unpaid_balance"`
+	Payouts       []ownerGetPayoutsResponseItem `json:"payouts"`
+}
+
+type ownerGetPayoutsResponseItem struct {
+	ID          string `json:"id"`
+	PeriodStart string `json:"period_start"`
+	Amount      int    `json:"amount"`
+	RideCount   int    `json:"ride_count"`
+	CreatedAt   int64  `json:"created_at"`
+}
+
+func ownerGetPayouts(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	payouts := []OwnerPayout{}
+	if err := tx.SelectContext(ctx, &payouts, "SELECT * FROM owner_payouts WHERE owner_id = ? ORDER BY period_start DESC", owner.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	var balance int
+	if err := tx.GetContext(ctx, &balance, "SELECT IFNULL(-SUM(amount), 0) FROM ledger_entries WHERE owner_id = ? AND account = ?", owner.ID, ledgerAccountOwnerPayable); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := ownerGetPayoutsResponse{
+		UnpaidBalance: balance,
+		Payouts:       make([]ownerGetPayoutsResponseItem, 0, len(payouts)),
+	}
+	for _, payout := range payouts {
+		res.Payouts = append(res.Payouts, ownerGetPayoutsResponseItem{
+			ID:          payout.ID,
+			PeriodStart: payout.PeriodStart.Format(time.DateOnly),
+			Amount:      payout.Amount,
+			RideCount:   payout.RideCount,
+			CreatedAt:   payout.CreatedAt.UnixMilli(),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+type ownerGetPayoutStatementResponse struct {
+	PeriodStart string `json:"period_start"`
+	// closed なら支払いが確定している。open の期間は途中経過を返す
+	Status             string                                `json:"status"`
+	PayoutID           *string                               `json:"payout_id"`
+	Rides              []ownerGetPayoutStatementResponseRide `json:"rides"`
+	TotalFare          int                                   `json:"total_fare"`
+	TotalCharged       int                                   `json:"total_charged"`
+	TotalCouponSubsidy int                                   `json:"total_coupon_subsidy"`
+	TotalPlatformFee   int                                   `json:"total_platform_fee"`
+	TotalEarnings      int                                   `json:"total_earnings"`
+}
+
+type ownerGetPayoutStatementResponseRide struct {
+	RideID        string `json:"ride_id"`
+	ChairID       string `json:"chair_id"`
+	Fare          int    `json:"fare"`
+	Charged       int    `json:"charged"`
+	CouponSubsidy int    `json:"coupon_subsidy"`
+	PlatformFee   int    `json:"platform_fee"`
+	Earnings      int    `json:"earnings"`
+	CompletedAt   int64  `json:"completed_at"`
+}
+
+// 期間中に完了したライドごとの内訳を仕訳から組み立てる
+func ownerGetPayoutStatement(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	periodStart, err := time.Parse(time.DateOnly, r.PathValue("period_start"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	periodEnd := periodStart.Add(payoutPeriodLength)
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	res := ownerGetPayoutStatementResponse{
+		PeriodStart: periodStart.Format(time.DateOnly),
+		Status:      "open",
+		Rides:       []ownerGetPayoutStatementResponseRide{},
+	}
+
+	var closed bool
+	if err := tx.GetContext(ctx, &closed, "SELECT EXISTS (SELECT 1 FROM payout_periods WHERE period_start = ?)", periodStart); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if closed {
+		res.Status = "closed"
+		payoutID := ""
+		if err := tx.GetContext(ctx, &payoutID, "SELECT id FROM owner_payouts WHERE owner_id = ? AND period_start = ?", owner.ID, periodStart); err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+		} else {
+			res.PayoutID = &payoutID
+		}
+	}
+
+	entries := []struct {
+		LedgerEntry
+		ChairID string `db:"chair_id"`
+	}{}
+	if err := tx.SelectContext(
+		ctx,
+		&entries,
+		`SELECT ledger_entries.*, rides.chair_id FROM ledger_entries JOIN rides ON rides.id = ledger_entries.ride_id
+		 WHERE ledger_entries.owner_id = ? AND ledger_entries.created_at >= ? AND ledger_entries.created_at < ?
+		 ORDER BY ledger_entries.created_at`,
+		owner.ID, periodStart, periodEnd,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	indexByRideID := map[string]int{}
+	for _, entry := range entries {
+		i, ok := indexByRideID[*entry.RideID]
+		if !ok {
+			i = len(res.Rides)
+			indexByRideID[*entry.RideID] = i
+			res.Rides = append(res.Rides, ownerGetPayoutStatementResponseRide{
+				RideID:      *entry.RideID,
+				ChairID:     entry.ChairID,
+				CompletedAt: entry.CreatedAt.UnixMilli(),
+			})
+		}
+		ride := &res.Rides[i]
+		switch entry.Account {
+		case ledgerAccountRiderReceivable:
+			ride.Charged += entry.Amount
+		case ledgerAccountCouponSubsidy:
+			ride.CouponSubsidy += entry.Amount
+		case ledgerAccountPlatformRevenue:
+			ride.PlatformFee -= entry.Amount
+		case ledgerAccountOwnerPayable:
+			ride.Earnings -= entry.Amount
+		}
+	}
+	for i := range res.Rides {
+		ride := &res.Rides[i]
+		ride.Fare = ride.Charged + ride.CouponSubsidy
+		res.TotalFare += ride.Fare
+		res.TotalCharged += ride.Charged
+		res.TotalCouponSubsidy += ride.CouponSubsidy
+		res.TotalPlatformFee += ride.PlatformFee
+		res.TotalEarnings += ride.Earnings
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+type ownerSalesExportRow struct {
+	RideID               string    `db:"ride_id" json:"ride_id"`
+	ChairID              string    `db:"chair_id" json:"chair_id"`
+	ChairName            string    `db:"chair_name" json:"chair_name"`
+	Model                string    `db:"model" json:"model"`
+	PickupLatitude       int       `db:"pickup_latitude" json:"pickup_latitude"`
+	PickupLongitude      int       `db:"pickup_longitude" json:"pickup_longitude"`
+	DestinationLatitude  int       `db:"destination_latitude" json:"destination_latitude"`
+	DestinationLongitude int       `db:"destination_longitude" json:"destination_longitude"`
+	RequestedAt          time.Time `db:"requested_at" json:"-"`
+	CompletedAt          time.Time `db:"completed_at" json:"-"`
+	Fare                 int       `db:"fare" json:"fare"`
+	Discount             int       `db:"discount" json:"discount"`
+	Charged              int       `db:"charged" json:"charged"`
+	Evaluation           *int      `db:"evaluation" json:"evaluation"`
+
+	RequestedAtMilli int64 `db:"-" json:"requested_at"`
+	CompletedAtMilli int64 `db:"-" json:"completed_at"`
+}
+
+var ownerSalesExportHeader = []string{
+	"ride_id", "chair_id", "chair_name", "model",
+	"pickup_latitude", "pickup_longitude", "destination_latitude", "destination_longitude",
+	"requested_at", "completed_at", "fare", "discount", "charged", "evaluation",
+}
+
+func (row *ownerSalesExportRow) csvRecord() []string {
+	evaluation := ""
+	if row.Evaluation != nil {
+		evaluation = strconv.Itoa(*row.Evaluation)
+	}
+	return []string{
+		row.RideID, row.ChairID, row.ChairName, row.Model,
+		strconv.Itoa(row.PickupLatitude), strconv.Itoa(row.PickupLongitude),
+		strconv.Itoa(row.DestinationLatitude), strconv.Itoa(row.DestinationLongitude),
+		strconv.FormatInt(row.RequestedAtMilli, 10), strconv.FormatInt(row.CompletedAtMilli, 10),
+		strconv.Itoa(row.Fare), strconv.Itoa(row.Discount), strconv.Itoa(row.Charged), evaluation,
+	}
+}
+
+// 期間中に完了したライドを1行ずつ書き出す
+// format は csv (既定) または ndjson。全件をメモリに載せないよう、行を読みながら書き出す
+func ownerGetSalesExport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	since, until, err := parseSalesPeriod(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "ndjson" {
+		writeError(w, http.StatusBadRequest, errors.New("format must be csv or ndjson"))
+		return
+	}
+
+	owner := ctx.Value("owner").(*Owner)
+
+	rows, err := db.QueryxContext(
+		ctx,
+		`SELECT ride_sales.ride_id, ride_sales.chair_id, chairs.name AS chair_name, chairs.model,
+		        rides.pickup_latitude, rides.pickup_longitude, rides.destination_latitude, rides.destination_longitude,
+		        rides.created_at AS requested_at, ride_sales.completed_at,
+		        ride_sales.fare, ride_sales.discount, ride_sales.charged, rides.evaluation
+		 FROM ride_sales
+		 JOIN rides ON rides.id = ride_sales.ride_id
+		 JOIN chairs ON chairs.id = ride_sales.chair_id
+		 WHERE ride_sales.owner_id = ? AND ride_sales.completed_at BETWEEN ? AND ? + INTERVAL 999 MICROSECOND
+		 ORDER BY ride_sales.completed_at`,
+		owner.ID, since, until,
+	)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer rows.Close()
+
+	var write func(row *ownerSalesExportRow) error
+	var flush func() error
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		cw := csv.NewWriter(w)
+		// バッファに書くだけなので失敗しない
+		_ = cw.Write(ownerSalesExportHeader)
+		write = func(row *ownerSalesExportRow) error { return cw.Write(row.csvRecord()) }
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		write = func(row *ownerSalesExportRow) error { return enc.Encode(row) }
+		flush = func() error { return nil }
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="sales-%s.%s"`, owner.ID, format))
+	w.WriteHeader(http.StatusOK)
+
+	// ヘッダーを送った後は失敗してもステータスコードを変えられないので、
+	// 途中までのファイルを正常なものと取り違えないよう接続ごと打ち切る
+	abort := func(err error) {
+		slog.Error("failed to export sales", slog.Any("error", err))
+		panic(http.ErrAbortHandler)
+	}
+	flusher, _ := w.(http.Flusher)
+	count := 0
+	for rows.Next() {
+		row := &ownerSalesExportRow{}
+		if err := rows.StructScan(row); err != nil {
+			abort(err)
+		}
+		row.RequestedAtMilli = row.RequestedAt.UnixMilli()
+		row.CompletedAtMilli = row.CompletedAt.UnixMilli()
+		if err := write(row); err != nil {
+			abort(err)
+		}
+		count++
+		if count%100 == 0 {
+			if err := flush(); err != nil {
+				abort(err)
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		abort(err)
+	}
+	if err := flush(); err != nil {
+		abort(err)
+	}
+}
+
+var errChairNotFound = errors.New("chair not found")
+
+// オーナーが所有する椅子を行ロックを取って取得する
+func getOwnerChairForUpdate(ctx context.Context, tx *sqlx.Tx, ownerID string, chairID string) (*Chair, error) {
+	chair := &Chair{}
+	if err := tx.GetContext(ctx, chair, "SELECT * FROM chairs WHERE id = ? AND owner_id = ? FOR UPDATE", chairID, ownerID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errChairNotFound
+		}
+		return nil, err
+	}
+	return chair, nil
+}
+
+type ownerPatchChairRequest struct {
+	Name  *string `json:"name"`
+	Model *string `json:"model"`
+}
+
+type ownerChairResponse struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Model     string `json:"model"`
+	Active    bool   `json:"active"`
+	Suspended bool   `json:"suspended"`
+	RetiredAt *int64 `json:"retired_at,omitempty"`
+}
+
+func newOwnerChairResponse(chair *Chair) *ownerChairResponse {
+	res := &ownerChairResponse{
+		ID:        chair.ID,
+		Name:      chair.Name,
+		Model:     chair.Model,
+		Active:    chair.IsActive,
+		Suspended: chair.SuspendedAt != nil,
+	}
+	if chair.RetiredAt != nil {
+		t := chair.RetiredAt.UnixMilli()
+		res.RetiredAt = &t
+	}
+	return res
+}
+
+// 椅子の名前やモデルを変更する
+func ownerPatchChair(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	chairID := r.PathValue("chair_id")
+
+	req := &ownerPatchChairRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Name != nil && (*req.Name == "" || len([]rune(*req.Name)) > 30) {
+		writeError(w, http.StatusBadRequest, errors.New("name must be 1-30 characters"))
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	chair, err := getOwnerChairForUpdate(ctx, tx, owner.ID, chairID)
+	if err != nil {
+		if errors.Is(err, errChairNotFound) {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if chair.RetiredAt != nil {
+		writeError(w, http.StatusConflict, errors.New("chair is retired"))
+		return
+	}
+
+	if req.Name != nil {
+		chair.Name = *req.Name
+	}
+	if req.Model != nil {
+		var exists bool
+		if err := tx.GetContext(ctx, &exists, "SELECT EXISTS (SELECT 1 FROM chair_models WHERE name = ?)", *req.Model); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if !exists {
+			writeError(w, http.StatusBadRequest, errors.New("unknown chair model"))
+			return
+		}
+		chair.Model = *req.Model
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE chairs SET name = ?, model = ? WHERE id = ?", chair.Name, chair.Model, chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	cacheDeleteChair(chair.AccessToken)
+
+	writeJSON(w, http.StatusOK, newOwnerChairResponse(chair))
+}
+
+// 椅子の受付を強制的に停止する。停止中は椅子から受付を再開できない
+func ownerPostChairSuspend(w http.ResponseWriter, r *http.Request) {
+	ownerUpdateChairState(w, r, "UPDATE chairs SET is_active = FALSE, suspended_at = CURRENT_TIMESTAMP(6) WHERE id = ?", chairActivityReasonSuspended)
+}
+
+// 強制停止を解除する。受付の再開は椅子から行う
+func ownerPostChairResume(w http.ResponseWriter, r *http.Request) {
+	ownerUpdateChairState(w, r, "UPDATE chairs SET suspended_at = NULL WHERE id = ?", "")
+}
+
+// 受付が止まった場合は reason を理由として履歴に残す
+func ownerUpdateChairState(w http.ResponseWriter, r *http.Request, query string, reason string) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	chairID := r.PathValue("chair_id")
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	chair, err := getOwnerChairForUpdate(ctx, tx, owner.ID, chairID)
+	if err != nil {
+		if errors.Is(err, errChairNotFound) {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if chair.RetiredAt != nil {
+		writeError(w, http.StatusConflict, errors.New("chair is retired"))
+		return
+	}
+
+	wasActive := chair.IsActive
+	if _, err := tx.ExecContext(ctx, query, chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := tx.GetContext(ctx, chair, "SELECT * FROM chairs WHERE id = ?", chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if wasActive && !chair.IsActive {
+		if err := recordChairActivity(ctx, tx, chair.ID, false, reason); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	cacheDeleteChair(chair.AccessToken)
+
+	writeJSON(w, http.StatusOK, newOwnerChairResponse(chair))
+}
+
+// 椅子を引退させる。引退した椅子は元に戻せず、アクセストークンも無効になる
+func ownerPostChairRetire(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	chairID := r.PathValue("chair_id")
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	chair, err := getOwnerChairForUpdate(ctx, tx, owner.ID, chairID)
+	if err != nil {
+		if errors.Is(err, errChairNotFound) {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if chair.RetiredAt != nil {
+		writeError(w, http.StatusConflict, errors.New("chair is already retired"))
+		return
+	}
+
+	// 走行中のライドがある椅子は引退させられない
+	var riding bool
+	if err := tx.GetContext(
+		ctx,
+		&riding,
+		`SELECT EXISTS (SELECT 1 FROM rides WHERE chair_id = ? AND NOT EXISTS (SELECT 1 FROM ride_statuses WHERE ride_id = rides.id AND status = 'COMPLETED'))`,
+		chair.ID,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if riding {
+		writeError(w, http.StatusConflict, errors.New("chair has an ongoing ride"))
+		return
+	}
+
+	if _, err := tx.ExecContext(
+		ctx,
+		"UPDATE chairs SET is_active = FALSE, retired_at = CURRENT_TIMESTAMP(6), access_token = ? WHERE id = ?",
+		secureRandomStr(32), chair.ID,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if chair.IsActive {
+		if err := recordChairActivity(ctx, tx, chair.ID, false, chairActivityReasonRetired); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	oldAccessToken := chair.AccessToken
+	if err := tx.GetContext(ctx, chair, "SELECT * FROM chairs WHERE id = ?", chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	cacheDeleteChair(oldAccessToken)
+
+	writeJSON(w, http.StatusOK, newOwnerChairResponse(chair))
+}
+
+type ownerPostChairAccessTokenResponse struct {
+	AccessToken string `json:"access_token"`
+}
+
+// 椅子のアクセストークンを再発行する。古いトークンはすぐに使えなくなる
+func ownerPostChairAccessToken(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	chairID := r.PathValue("chair_id")
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	chair, err := getOwnerChairForUpdate(ctx, tx, owner.ID, chairID)
+	if err != nil {
+		if errors.Is(err, errChairNotFound) {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if chair.RetiredAt != nil {
+		writeError(w, http.StatusConflict, errors.New("chair is retired"))
+		return
+	}
+
+	accessToken := secureRandomStr(32)
+	if _, err := tx.ExecContext(ctx, "UPDATE chairs SET access_token = ? WHERE id = ?", accessToken, chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	cacheDeleteChair(chair.AccessToken)
+
+	writeJSON(w, http.StatusOK, &ownerPostChairAccessTokenResponse{
+		AccessToken: accessToken,
+	})
+}
+
+type ownerPostChairRegisterTokenResponse struct {
+	ChairRegisterToken string `json:"chair_register_token"`
+}
+
+// オーナーの椅子登録トークンを再発行する。古いトークンはすぐに使えなくなる
+func ownerPostChairRegisterToken(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	chairRegisterToken := secureRandomStr(32)
+	if _, err := db.ExecContext(ctx, "UPDATE owners SET chair_register_token = ? WHERE id = ?", chairRegisterToken, owner.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &ownerPostChairRegisterTokenResponse{
+		ChairRegisterToken: chairRegisterToken,
+	})
+}
+
+type ownerPostChairRegisterTokensRequest struct {
+	MaxChairs *int    `json:"max_chairs"`
+	Model     *string `json:"model"`
+	// UnixMilli
+	ExpiresAt *int64 `json:"expires_at"`
+}
+
+type ownerChairRegisterTokenResponse struct {
+	ID                 string  `json:"id"`
+	ChairRegisterToken string  `json:"chair_register_token"`
+	MaxChairs          *int    `json:"max_chairs"`
+	RegisteredCount    int     `json:"registered_count"`
+	Model              *string `json:"model"`
+	ExpiresAt          *int64  `json:"expires_at"`
+	Revoked            bool    `json:"revoked"`
+	CreatedAt          int64   `json:"created_at"`
+}
+
+func newOwnerChairRegisterTokenResponse(token *ChairRegisterToken) ownerChairRegisterTokenResponse {
+	res := ownerChairRegisterTokenResponse{
+		ID:                 token.ID,
+		ChairRegisterToken: token.Token,
+		MaxChairs:          token.MaxChairs,
+		RegisteredCount:    token.RegisteredCount,
+		Model:              token.Model,
+		Revoked:            token.RevokedAt != nil,
+		CreatedAt:          token.CreatedAt.UnixMilli(),
+	}
+	if token.ExpiresAt != nil {
+		t := token.ExpiresAt.UnixMilli()
+		res.ExpiresAt = &t
+	}
+	return res
+}
+
+// 登録できる椅子の数、有効期限、モデルを制限した椅子登録トークンを発行する
+func ownerPostChairRegisterTokens(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	req := &ownerPostChairRegisterTokensRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.MaxChairs != nil && *req.MaxChairs <= 0 {
+		writeError(w, http.StatusBadRequest, errors.New("max_chairs must be positive"))
+		return
+	}
+	var expiresAt *time.Time
+	if req.ExpiresAt != nil {
+		t := time.UnixMilli(*req.ExpiresAt)
+		if !t.After(time.Now()) {
+			writeError(w, http.StatusBadRequest, errors.New("expires_at must be in the future"))
+			return
+		}
+		expiresAt = &t
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	if req.Model != nil {
+		var exists bool
+		if err := tx.GetContext(ctx, &exists, "SELECT EXISTS (SELECT 1 FROM chair_models WHERE name = ?)", *req.Model); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if !exists {
+			writeError(w, http.StatusBadRequest, errors.New("unknown chair model"))
+			return
+		}
+	}
+
+	tokenID := ulid.Make().String()
+	if _, err := tx.ExecContext(
+		ctx,
+		"INSERT INTO chair_register_tokens (id, owner_id, token, max_chairs, model, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
+		tokenID, owner.ID, secureRandomStr(32), req.MaxChairs, req.Model, expiresAt,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	token := &ChairRegisterToken{}
+	if err := tx.GetContext(ctx, token, "SELECT * FROM chair_register_tokens WHERE id = ?", tokenID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, newOwnerChairRegisterTokenResponse(token))
+}
+
+type ownerGetChairRegisterTokensResponse struct {
+	Tokens []ownerChairRegisterTokenResponse `json:"tokens"`
+}
+
+func ownerGetChairRegisterTokens(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	tokens := []ChairRegisterToken{}
+	if err := db.SelectContext(ctx, &tokens, "SELECT * FROM chair_register_tokens WHERE owner_id = ? ORDER BY created_at DESC", owner.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := ownerGetChairRegisterTokensResponse{
+		Tokens: make([]ownerChairRegisterTokenResponse, 0, len(tokens)),
+	}
+	for _, token := range tokens {
+		res.Tokens = append(res.Tokens, newOwnerChairRegisterTokenResponse(&token))
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func ownerDeleteChairRegisterToken(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	result, err := db.ExecContext(
+		ctx,
+		"UPDATE chair_register_tokens SET revoked_at = CURRENT_TIMESTAMP(6) WHERE id = ? AND owner_id = ? AND revoked_at IS NULL",
+		r.PathValue("token_id"), owner.ID,
+	)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if count, err := result.RowsAffected(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if count == 0 {
+		writeError(w, http.StatusNotFound, errors.New("chair register token not found"))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type ownerGetChairRegistrationsResponse struct {
+	Registrations []ownerGetChairRegistrationsResponseItem `json:"registrations"`
+}
+
+type ownerGetChairRegistrationsResponseItem struct {
+	ID              string  `json:"id"`
+	RegisterTokenID *string `json:"register_token_id"`
+	ChairID         *string `json:"chair_id"`
+	Name            string  `json:"name"`
+	Model           string  `json:"model"`
+	Result          string  `json:"result"`
+	Reason          *string `json:"reason"`
+	RemoteAddr      string  `json:"remote_addr"`
+	UserAgent       string  `json:"user_agent"`
+	CreatedAt       int64   `json:"created_at"`
+}
+
+// 椅子登録の監査ログを新しい順に返す
+func ownerGetChairRegistrations(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed <= 0 || parsed > 1000 {
+			writeError(w, http.StatusBadRequest, errors.New("limit must be between 1 and 1000"))
+			return
+		}
+		limit = parsed
+	}
+
+	registrations := []ChairRegistration{}
+	if err := db.SelectContext(
+		ctx,
+		&registrations,
+		"SELECT * FROM chair_registrations WHERE owner_id = ? ORDER BY created_at DESC LIMIT ?",
+		owner.ID, limit,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := ownerGetChairRegistrationsResponse{
+		Registrations: make([]ownerGetChairRegistrationsResponseItem, 0, len(registrations)),
+	}
+	for _, registration := range registrations {
+		res.Registrations = append(res.Registrations, ownerGetChairRegistrationsResponseItem{
+			ID:              registration.ID,
+			RegisterTokenID: registration.RegisterTokenID,
+			ChairID:         registration.ChairID,
+			Name:            registration.Name,
+			Model:           registration.Model,
+			Result:          registration.Result,
+			Reason:          registration.Reason,
+			RemoteAddr:      registration.RemoteAddr,
+			UserAgent:       registration.UserAgent,
+			CreatedAt:       registration.CreatedAt.UnixMilli(),
+		})
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// 椅子の現在の位置と走行中のライドを返す
+func ownerGetFleet(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	res, err := getOwnerFleet(ctx, owner.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+const (
+	ownerFleetStreamDefaultInterval = time.Second
+	ownerFleetStreamMinInterval     = 500 * time.Millisecond
+)
+
+// ownerGetFleet と同じ内容を Server-Sent Events で interval_ms ごとに送り続ける
+func ownerGetFleetStream(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	interval := ownerFleetStreamDefaultInterval
+	if v := r.URL.Query().Get("interval_ms"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		interval = max(time.Duration(parsed)*time.Millisecond, ownerFleetStreamMinInterval)
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+
+	if !acquireOwnerFleetStream(owner.ID) {
+		writeError(w, http.StatusTooManyRequests, errors.New("too many fleet streams"))
+		return
+	}
+	defer releaseOwnerFleetStream(owner.ID)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// nginx にバッファリングさせない
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		res, err := getOwnerFleet(ctx, owner.ID)
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Error("failed to stream fleet", slog.Any("error", err))
+			}
+			return
+		}
+		data, err := json.Marshal(res)
+		if err != nil {
+			slog.Error("failed to stream fleet", slog.Any("error", err))
+			return
+		}
+		if _, err := fmt.Fprintf(w, "event: fleet\ndata: %s\n\n", data); err != nil {
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type ownerGetChairDetailResponse struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	Model         string `json:"model"`
+	Active        bool   `json:"active"`
+	Suspended     bool   `json:"suspended"`
+	RetiredAt     *int64 `json:"retired_at,omitempty"`
+	RegisteredAt  int64  `json:"registered_at"`
+	TotalDistance int    `json:"total_distance"`
+	// 評価ごとのライド数 ("1" - "5")
+	RatingDistribution map[string]int                    `json:"rating_distribution"`
+	AverageRating      float64                           `json:"average_rating"`
+	Rides              []ownerGetChairDetailResponseRide `json:"rides"`
+	// 次のページを取得するときに before に指定する。最後のページなら含まない
+	NextCursor *string `json:"next_cursor,omitempty"`
+}
+
+type ownerGetChairDetailResponseRide struct {
+	ID                    string     `json:"id"`
+	PickupCoordinate      Coordinate `json:"pickup_coordinate"`
+	DestinationCoordinate Coordinate `json:"destination_coordinate"`
+	Fare                  int        `json:"fare"`
+	// 完了したライドのみ
+	Discount   *int `json:"discount,omitempty"`
+	Charged    *int `json:"charged,omitempty"`
+	Evaluation *int `json:"evaluation"`
+	// ステータスごとの遷移日時 (UnixMilli)
+	StatusTimestamps map[string]int64 `json:"status_timestamps"`
+	RequestedAt      int64            `json:"requested_at"`
+}
+
+// 椅子の詳細と、新しい順のライド履歴を返す
+// limit (既定 20、最大 100) 件ずつ返し、before に前のページの next_cursor を指定すると続きを返す
+func ownerGetChairDetail(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	chairID := r.PathValue("chair_id")
+
+	limit := 20
+	if v := r.URL.Query().Get("limit"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed <= 0 || parsed > 100 {
+			writeError(w, http.StatusBadRequest, errors.New("limit must be between 1 and 100"))
+			return
+		}
+		limit = parsed
+	}
+	before := r.URL.Query().Get("before")
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	chair := &Chair{}
+	if err := tx.GetContext(ctx, chair, "SELECT * FROM chairs WHERE id = ? AND owner_id = ?", chairID, owner.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errChairNotFound)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := ownerGetChairDetailResponse{
+		ID:                 chair.ID,
+		Name:               chair.Name,
+		Model:              chair.Model,
+		Active:             chair.IsActive,
+		Suspended:          chair.SuspendedAt != nil,
+		RegisteredAt:       chair.CreatedAt.UnixMilli(),
+		RatingDistribution: map[string]int{"1": 0, "2": 0, "3": 0, "4": 0, "5": 0},
+		Rides:              []ownerGetChairDetailResponseRide{},
+	}
+	if chair.RetiredAt != nil {
+		t := chair.RetiredAt.UnixMilli()
+		res.RetiredAt = &t
+	}
+
+	if err := tx.GetContext(
+		ctx,
+		&res.TotalDistance,
+		"SELECT IFNULL((SELECT total_distance FROM chair_distances WHERE chair_id = ?), 0)",
+		chair.ID,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	ratings := []struct {
+		Evaluation int `db:"evaluation"`
+		Count      int `db:"count"`
+	}{}
+	if err := tx.SelectContext(ctx, &ratings, "SELECT evaluation, COUNT(*) AS count FROM rides WHERE chair_id = ? AND evaluation IS NOT NULL GROUP BY evaluation", chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	ratingCount, ratingSum := 0, 0
+	for _, rating := range ratings {
+		res.RatingDistribution[strconv.Itoa(rating.Evaluation)] = rating.Count
+		ratingCount += rating.Count
+		ratingSum += rating.Evaluation * rating.Count
+	}
+	if ratingCount > 0 {
+		res.AverageRating = float64(ratingSum) / float64(ratingCount)
+	}
+
+	// ライドIDは ULID なので作成順に並ぶ
+	rides := []struct {
+		Ride
+		Discount *int `db:"discount"`
+		Charged  *int `db:"charged"`
+	}{}
+	query := "SELECT rides.*, ride_sales.discount, ride_sales.charged FROM rides LEFT JOIN ride_sales ON ride_sales.ride_id = rides.id WHERE rides.chair_id = ?"
+	args := []any{chair.ID}
+	if before != "" {
+		query += " AND rides.id < ?"
+		args = append(args, before)
+	}
+	query += " ORDER BY rides.id DESC LIMIT ?"
+	args = append(args, limit+1)
+	if err := tx.SelectContext(ctx, &rides, query, args...); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(rides) > limit {
+		rides = rides[:limit]
+		res.NextCursor = &rides[limit-1].ID
+	}
+
+	if len(rides) > 0 {
+		rideIDs := make([]string, 0, len(rides))
+		for _, ride := range rides {
+			rideIDs = append(rideIDs, ride.ID)
+		}
+		query, args, err := sqlx.In("SELECT * FROM ride_statuses WHERE ride_id IN (?) ORDER BY created_at", rideIDs)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		statuses := []RideStatus{}
+		if err := tx.SelectContext(ctx, &statuses, query, args...); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		timestampsByRideID := make(map[string]map[string]int64, len(rides))
+		for _, status := range statuses {
+			if timestampsByRideID[status.RideID] == nil {
+				timestampsByRideID[status.RideID] = map[string]int64{}
+			}
+			timestampsByRideID[status.RideID][status.Status] = status.CreatedAt.UnixMilli()
+		}
+
+		for _, ride := range rides {
+			timestamps := timestampsByRideID[ride.ID]
+			if timestamps == nil {
+				timestamps = map[string]int64{}
+			}
+			res.Rides = append(res.Rides, ownerGetChairDetailResponseRide{
+				ID:                    ride.ID,
+				PickupCoordinate:      Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude},
+				DestinationCoordinate: Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude},
+				Fare:                  calculateSale(ride.Ride),
+				Discount:              ride.Discount,
+				Charged:               ride.Charged,
+				Evaluation:            ride.Evaluation,
+				StatusTimestamps:      timestamps,
+				RequestedAt:           ride.CreatedAt.UnixMilli(),
+			})
+		}
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+// 期間 (since, until) 中の椅子ごと・モデルごとの稼働状況を返す
+func ownerGetUtilization(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	since, until, err := parseSalesPeriod(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	res, err := getOwnerUtilization(ctx, owner.ID, since, until)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+type ownerGetNotificationsResponse struct {
+	Notifications []ownerNotification `json:"notifications"`
+}
+
+type ownerNotification struct {
+	ID        string  `json:"id"`
+	ChairID   *string `json:"chair_id,omitempty"`
+	Type      string  `json:"type"`
+	Message   string  `json:"message"`
+	CreatedAt int64   `json:"created_at"`
+	ReadAt    *int64  `json:"read_at,omitempty"`
+}
+
+// オーナーへの通知を新しい順に返す。unread=1 を指定すると未読のもののみ
+func ownerGetNotifications(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	query := "SELECT * FROM owner_notifications WHERE owner_id = ? ORDER BY created_at DESC LIMIT 100"
+	if r.URL.Query().Get("unread") == "1" {
+		query = "SELECT * FROM owner_notifications WHERE owner_id = ? AND read_at IS NULL ORDER BY created_at DESC LIMIT 100"
+	}
+	notifications := []OwnerNotification{}
+	if err := db.SelectContext(ctx, &notifications, query, owner.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := ownerGetNotificationsResponse{Notifications: make([]ownerNotification, 0, len(notifications))}
+	for _, n := range notifications {
+		item := ownerNotification{
+			ID:        n.ID,
+			ChairID:   n.ChairID,
+			Type:      n.Type,
+			Message:   n.Message,
+			CreatedAt: n.CreatedAt.UnixMilli(),
+		}
+		if n.ReadAt != nil {
+			t := n.ReadAt.UnixMilli()
+			item.ReadAt = &t
+		}
+		res.Notifications = append(res.Notifications, item)
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func ownerPostNotificationRead(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	notificationID := r.PathValue("notification_id")
+
+	var exists bool
+	if err := db.GetContext(ctx, &exists, "SELECT EXISTS (SELECT 1 FROM owner_notifications WHERE id = ? AND owner_id = ?)", notificationID, owner.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, errors.New("notification not found"))
+		return
+	}
+	if _, err := db.ExecContext(ctx, "UPDATE owner_notifications SET read_at = IFNULL(read_at, CURRENT_TIMESTAMP(6)) WHERE id = ?", notificationID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
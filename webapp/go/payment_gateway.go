@@ -5,7 +5,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
 	"time"
 
 	"github.com/goccy/go-json"
@@ -18,81 +23,252 @@ type paymentGatewayPostPaymentRequest struct {
 }
 
 type paymentGatewayGetPaymentsResponseOne struct {
-	Amount int    `json:"amount"`
-	Status string `json:"status"`
+	Amount         int    `json:"amount"`
+	Status         string `json:"status"`
+	IdempotencyKey string `json:"idempotency_key"`
+	RefundedAmount int    `json:"refunded_amount"`
 }
 
-func requestPaymentGatewayPostPayment(ctx context.Context, paymentGatewayURL string, token string, param *paymentGatewayPostPaymentRequest, retrieveRidesOrderByCreatedAtAsc func() ([]Ride, error)) error {
+type paymentGatewayPostRefundRequest struct {
+	Amount int `json:"amount"`
+}
+
+// 社内決済マイクロサービスのクライアント
+// PostPayment は同じ idempotencyKey で何度呼んでも一度しか決済されない
+type PaymentGateway interface {
+	PostPayment(ctx context.Context, token string, idempotencyKey string, param *paymentGatewayPostPaymentRequest) error
+	GetPayments(ctx context.Context, token string) ([]paymentGatewayGetPaymentsResponseOne, error)
+	// paymentKey で決済した決済を返金する。同じ idempotencyKey で何度呼んでも一度しか返金されない
+	PostRefund(ctx context.Context, token string, paymentKey string, idempotencyKey string, param *paymentGatewayPostRefundRequest) error
+}
+
+// 決済マイクロサービスが想定外のステータスコードを返したときのエラー
+type PaymentGatewayError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Body       string
+}
+
+func (e *PaymentGatewayError) Error() string {
+	return fmt.Sprintf("[%s %s] unexpected status code (%d): %s", e.Method, e.Path, e.StatusCode, e.Body)
+}
+
+func (e *PaymentGatewayError) Unwrap() error {
+	return erroredUpstream
+}
+
+type paymentGatewayConfig struct {
+	// 1リクエストあたりのタイムアウト
+	RequestTimeout time.Duration
+	// 決済が失敗したときのリトライ回数。これを超えたら failed にする
+	MaxRetries int
+	// 最初のリトライまでの間隔。以降は試行ごとに倍にする
+	RetryInterval time.Duration
+	// 同時に送るリクエスト数の上限
+	MaxConcurrency int
+}
+
+var defaultPaymentGatewayConfig = paymentGatewayConfig{
+	RequestTimeout: 3 * time.Second,
+	MaxRetries:     5,
+	RetryInterval:  100 * time.Millisecond,
+	MaxConcurrency: 8,
+}
+
+var (
+	paymentGatewaySettings = defaultPaymentGatewayConfig
+	// 決済マイクロサービスのURLからクライアントを作る。ISUCON_PAYMENT_GATEWAY=fake ならインメモリの実装を使う
+	newPaymentGateway func(baseURL string) PaymentGateway
+
+	// 決済マイクロサービスへの同時リクエスト数の制限とサーキットブレーカーはプロセス全体で共有する
+	paymentGatewayLimiter chan struct{}
+	paymentGatewayBreaker *circuitBreaker
+	paymentGatewayStats   *paymentGatewayMetrics
+)
+
+func setupPaymentGateway() {
+	if v := os.Getenv("ISUCON_PAYMENT_GATEWAY_TIMEOUT_MS"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil {
+			panic(fmt.Sprintf("failed to convert ISUCON_PAYMENT_GATEWAY_TIMEOUT_MS into int: %v", err))
+		}
+		paymentGatewaySettings.RequestTimeout = time.Duration(ms) * time.Millisecond
+	}
+	if v := os.Getenv("ISUCON_PAYMENT_GATEWAY_MAX_RETRIES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			panic(fmt.Sprintf("failed to convert ISUCON_PAYMENT_GATEWAY_MAX_RETRIES into int: %v", err))
+		}
+		paymentGatewaySettings.MaxRetries = n
+	}
+	if v := os.Getenv("ISUCON_PAYMENT_GATEWAY_CONCURRENCY"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			panic(fmt.Sprintf("failed to convert ISUCON_PAYMENT_GATEWAY_CONCURRENCY into positive int: %v", v))
+		}
+		paymentGatewaySettings.MaxConcurrency = n
+	}
+
+	paymentGatewayLimiter = make(chan struct{}, paymentGatewaySettings.MaxConcurrency)
+	paymentGatewayBreaker = newCircuitBreaker(defaultCircuitBreakerConfig)
+	paymentGatewayStats = &paymentGatewayMetrics{}
+
+	if os.Getenv("ISUCON_PAYMENT_GATEWAY") == "fake" {
+		fake := newFakePaymentGateway()
+		newPaymentGateway = func(string) PaymentGateway {
+			return newGuardedPaymentGateway(fake, paymentGatewayLimiter, paymentGatewayBreaker, paymentGatewayStats)
+		}
+		return
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConns:          100,
+			MaxIdleConnsPerHost:   100,
+			IdleConnTimeout:       90 * time.Second,
+			ResponseHeaderTimeout: paymentGatewaySettings.RequestTimeout,
+		},
+	}
+	newPaymentGateway = func(baseURL string) PaymentGateway {
+		return newGuardedPaymentGateway(&httpPaymentGateway{
+			baseURL: baseURL,
+			client:  client,
+			timeout: paymentGatewaySettings.RequestTimeout,
+		}, paymentGatewayLimiter, paymentGatewayBreaker, paymentGatewayStats)
+	}
+}
+
+type httpPaymentGateway struct {
+	baseURL string
+	client  *http.Client
+	timeout time.Duration
+}
+
+func (g *httpPaymentGateway) PostPayment(ctx context.Context, token string, idempotencyKey string, param *paymentGatewayPostPaymentRequest) error {
 	b, err := json.Marshal(param)
 	if err != nil {
 		return err
 	}
 
-	// 失敗したらとりあえずリトライ
-	// FIXME: 社内決済マイクロサービスのインフラに異常が発生していて、同時にたくさんリクエストすると変なことになる可能性あり
-	retry := 0
-	for {
-		err := func() error {
-			req, err := http.NewRequestWithContext(ctx, http.MethodPost, paymentGatewayURL+"/payments", bytes.NewBuffer(b))
-			if err != nil {
-				return err
-			}
-			req.Header.Set("Content-Type", "application/json")
-			req.Header.Set("Authorization", "Bearer "+token)
+	res, err := g.do(ctx, http.MethodPost, "/payments", token, b, map[string]string{"Idempotency-Key": idempotencyKey})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
 
-			res, err := http.DefaultClient.Do(req)
-			if err != nil {
-				return err
-			}
-			defer res.Body.Close()
-
-			if res.StatusCode != http.StatusNoContent {
-				// エラーが返ってきても成功している場合があるので、社内決済マイクロサービスに問い合わせ
-				getReq, err := http.NewRequestWithContext(ctx, http.MethodGet, paymentGatewayURL+"/payments", bytes.NewBuffer([]byte{}))
-				if err != nil {
-					return err
-				}
-				getReq.Header.Set("Authorization", "Bearer "+token)
-
-				getRes, err := http.DefaultClient.Do(getReq)
-				if err != nil {
-					return err
-				}
-				defer res.Body.Close()
-
-				// GET /payments は障害と関係なく200が返るので、200以外は回復不能なエラーとする
-				if getRes.StatusCode != http.StatusOK {
-					return fmt.Errorf("[GET /payments] unexpected status code (%d)", getRes.StatusCode)
-				}
-				var payments []paymentGatewayGetPaymentsResponseOne
-				if err := json.NewDecoder(getRes.Body).Decode(&payments); err != nil {
-					return err
-				}
-
-				rides, err := retrieveRidesOrderByCreatedAtAsc()
-				if err != nil {
-					return err
-				}
-
-				if len(rides) != len(payments) {
-					return fmt.Errorf("unexpected number of payments: %d != %d. %w", len(rides), len(payments), erroredUpstream)
-				}
+	if res.StatusCode != http.StatusNoContent {
+		return newPaymentGatewayError(res, http.MethodPost, "/payments")
+	}
+	return nil
+}
+
+func (g *httpPaymentGateway) GetPayments(ctx context.Context, token string) ([]paymentGatewayGetPaymentsResponseOne, error) {
+	res, err := g.do(ctx, http.MethodGet, "/payments", token, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	// GET /payments は障害と関係なく200が返るので、200以外は回復不能なエラーとする
+	if res.StatusCode != http.StatusOK {
+		return nil, newPaymentGatewayError(res, http.MethodGet, "/payments")
+	}
+	var payments []paymentGatewayGetPaymentsResponseOne
+	if err := json.NewDecoder(res.Body).Decode(&payments); err != nil {
+		return nil, err
+	}
+	return payments, nil
+}
+
+func (g *httpPaymentGateway) PostRefund(ctx context.Context, token string, paymentKey string, idempotencyKey string, param *paymentGatewayPostRefundRequest) error {
+	b, err := json.Marshal(param)
+	if err != nil {
+		return err
+	}
+
+	path := "/payments/" + url.PathEscape(paymentKey) + "/refunds"
+	res, err := g.do(ctx, http.MethodPost, path, token, b, map[string]string{"Idempotency-Key": idempotencyKey})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent {
+		return newPaymentGatewayError(res, http.MethodPost, path)
+	}
+	return nil
+}
 
+// タイムアウト付きでリクエストを送る。レスポンスボディは読み終わるまでキャンセルされない
+func (g *httpPaymentGateway) do(ctx context.Context, method, path, token string, body []byte, header map[string]string) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(ctx, g.timeout)
+	req, err := http.NewRequestWithContext(ctx, method, g.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+
+	res, err := g.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	res.Body = &cancelOnClose{ReadCloser: res.Body, cancel: cancel}
+	return res, nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+func newPaymentGatewayError(res *http.Response, method, path string) error {
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	return &PaymentGatewayError{
+		Method:     method,
+		Path:       path,
+		StatusCode: res.StatusCode,
+		Body:       string(body),
+	}
+}
+
+// ライドごとの冪等キーを付けて一度だけ決済を試みる
+// 失敗しても決済されている場合があるので、冪等キーで決済の有無を確認する
+func requestPaymentGatewayPostPayment(ctx context.Context, gateway PaymentGateway, token string, idempotencyKey string, param *paymentGatewayPostPaymentRequest) error {
+	if err := gateway.PostPayment(ctx, token, idempotencyKey, param); err != nil {
+		if errors.Is(err, errPaymentGatewayUnavailable) {
+			return fmt.Errorf("%w: %w", errPaymentNotSent, err)
+		}
+		// エラーが返ってきても成功している場合があるので、社内決済マイクロサービスに問い合わせ
+		// 問い合わせがブレーカーに止められても、決済は送っているので送っていない扱いにはしない
+		payments, getErr := gateway.GetPayments(ctx, token)
+		if getErr != nil {
+			return getErr
+		}
+		for _, payment := range payments {
+			if payment.IdempotencyKey == idempotencyKey {
 				return nil
 			}
-			return nil
-		}()
-		if err != nil {
-			if retry < 5 {
-				retry++
-				time.Sleep(100 * time.Millisecond)
-				continue
-			} else {
-				return err
-			}
 		}
-		break
+		return fmt.Errorf("payment %s was not recorded: %w: %w", idempotencyKey, err, erroredUpstream)
 	}
-
 	return nil
 }
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// 決済マイクロサービスを使わずに動かすためのインメモリ実装
+type fakePaymentGateway struct {
+	mu         sync.Mutex
+	payments   map[string][]paymentGatewayGetPaymentsResponseOne
+	refundKeys map[string]bool
+}
+
+func newFakePaymentGateway() *fakePaymentGateway {
+	return &fakePaymentGateway{
+		payments:   map[string][]paymentGatewayGetPaymentsResponseOne{},
+		refundKeys: map[string]bool{},
+	}
+}
+
+func (g *fakePaymentGateway) PostPayment(ctx context.Context, token string, idempotencyKey string, param *paymentGatewayPostPaymentRequest) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, payment := range g.payments[token] {
+		if payment.IdempotencyKey == idempotencyKey {
+			return nil
+		}
+	}
+	g.payments[token] = append(g.payments[token], paymentGatewayGetPaymentsResponseOne{
+		Amount:         param.Amount,
+		Status:         "成功",
+		IdempotencyKey: idempotencyKey,
+	})
+	return nil
+}
+
+func (g *fakePaymentGateway) GetPayments(ctx context.Context, token string) ([]paymentGatewayGetPaymentsResponseOne, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	payments := make([]paymentGatewayGetPaymentsResponseOne, len(g.payments[token]))
+	copy(payments, g.payments[token])
+	return payments, nil
+}
+
+func (g *fakePaymentGateway) PostRefund(ctx context.Context, token string, paymentKey string, idempotencyKey string, param *paymentGatewayPostRefundRequest) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	path := "/payments/" + paymentKey + "/refunds"
+	for i := range g.payments[token] {
+		payment := &g.payments[token][i]
+		if payment.IdempotencyKey != paymentKey {
+			continue
+		}
+		if g.refundKeys[idempotencyKey] {
+			return nil
+		}
+		if param.Amount <= 0 || payment.RefundedAmount+param.Amount > payment.Amount {
+			return &PaymentGatewayError{Method: http.MethodPost, Path: path, StatusCode: http.StatusBadRequest, Body: "invalid refund amount"}
+		}
+		payment.RefundedAmount += param.Amount
+		g.refundKeys[idempotencyKey] = true
+		return nil
+	}
+	return &PaymentGatewayError{Method: http.MethodPost, Path: path, StatusCode: http.StatusNotFound, Body: "payment not found"}
+}
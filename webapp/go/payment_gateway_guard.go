@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// サーキットブレーカーが開いていて決済マイクロサービスにリクエストを送らなかったときのエラー
+var errPaymentGatewayUnavailable = errors.New("payment gateway is unavailable")
+
+// 決済のリクエスト自体をサーキットブレーカーに止められ、一度も送っていないときのエラー
+var errPaymentNotSent = errors.New("payment request was not sent")
+
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half_open"
+)
+
+type circuitBreakerConfig struct {
+	// 連続してこの回数失敗したら開く
+	FailureThreshold int
+	// 開いている時間の初期値。再び開くたびに倍になる
+	OpenBackoff time.Duration
+	// 開いている時間の上限
+	MaxOpenBackoff time.Duration
+}
+
+var defaultCircuitBreakerConfig = circuitBreakerConfig{
+	FailureThreshold: 5,
+	OpenBackoff:      500 * time.Millisecond,
+	MaxOpenBackoff:   30 * time.Second,
+}
+
+// closed -> (連続失敗) -> open -> (待機) -> half_open -> (試行が成功) -> closed
+// half_open では同時に1リクエストだけを試しに通し、失敗したら待機時間を延ばして再び open にする
+type circuitBreaker struct {
+	config circuitBreakerConfig
+
+	mu                  sync.Mutex
+	state               string
+	consecutiveFailures int
+	openCount           int
+	openUntil           time.Time
+	probing             bool
+}
+
+func newCircuitBreaker(config circuitBreakerConfig) *circuitBreaker {
+	return &circuitBreaker{
+		config: config,
+		state:  circuitClosed,
+	}
+}
+
+// リクエストを送ってよいか判定する。送ってよい場合は結果のエラーを done で報告する
+func (b *circuitBreaker) allow() (done func(err error), err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		if time.Now().Before(b.openUntil) {
+			return nil, errPaymentGatewayUnavailable
+		}
+		b.state = circuitHalfOpen
+		fallthrough
+	case circuitHalfOpen:
+		if b.probing {
+			return nil, errPaymentGatewayUnavailable
+		}
+		b.probing = true
+		return b.report(true), nil
+	default:
+		return b.report(false), nil
+	}
+}
+
+func (b *circuitBreaker) report(probe bool) func(err error) {
+	return func(err error) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		if probe {
+			b.probing = false
+		}
+		if errors.Is(err, context.Canceled) {
+			// 呼び出し側の都合で中断されたので状態を変えない
+			return
+		}
+		if !isPaymentGatewayFailure(err) {
+			b.state = circuitClosed
+			b.consecutiveFailures = 0
+			b.openCount = 0
+			return
+		}
+
+		b.consecutiveFailures++
+		if probe || b.consecutiveFailures >= b.config.FailureThreshold {
+			b.state = circuitOpen
+			b.openUntil = time.Now().Add(backoffWithJitter(b.config.OpenBackoff, b.openCount, b.config.MaxOpenBackoff))
+			b.openCount++
+		}
+	}
+}
+
+func (b *circuitBreaker) currentState() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == circuitOpen && !time.Now().Before(b.openUntil) {
+		return circuitHalfOpen
+	}
+	return b.state
+}
+
+// base * 2^attempt を上限 maxBackoff で抑え、その半分から全体の間でばらつかせる
+func backoffWithJitter(base time.Duration, attempt int, maxBackoff time.Duration) time.Duration {
+	backoff := maxBackoff
+	if attempt < 16 {
+		backoff = min(base<<attempt, maxBackoff)
+	}
+	half := backoff / 2
+	return half + rand.N(half+1)
+}
+
+type paymentGatewayMetrics struct {
+	inFlight  atomic.Int64
+	succeeded atomic.Int64
+	failed    atomic.Int64
+	rejected  atomic.Int64
+}
+
+// 同時リクエスト数の制限とサーキットブレーカーを挟んだクライアント
+type guardedPaymentGateway struct {
+	next    PaymentGateway
+	limiter chan struct{}
+	breaker *circuitBreaker
+	metrics *paymentGatewayMetrics
+}
+
+func newGuardedPaymentGateway(next PaymentGateway, limiter chan struct{}, breaker *circuitBreaker, metrics *paymentGatewayMetrics) *guardedPaymentGateway {
+	return &guardedPaymentGateway{
+		next:    next,
+		limiter: limiter,
+		breaker: breaker,
+		metrics: metrics,
+	}
+}
+
+func (g *guardedPaymentGateway) PostPayment(ctx context.Context, token string, idempotencyKey string, param *paymentGatewayPostPaymentRequest) error {
+	return g.call(ctx, func() error {
+		return g.next.PostPayment(ctx, token, idempotencyKey, param)
+	})
+}
+
+func (g *guardedPaymentGateway) GetPayments(ctx context.Context, token string) ([]paymentGatewayGetPaymentsResponseOne, error) {
+	var payments []paymentGatewayGetPaymentsResponseOne
+	err := g.call(ctx, func() error {
+		var err error
+		payments, err = g.next.GetPayments(ctx, token)
+		return err
+	})
+	return payments, err
+}
+
+func (g *guardedPaymentGateway) PostRefund(ctx context.Context, token string, paymentKey string, idempotencyKey string, param *paymentGatewayPostRefundRequest) error {
+	return g.call(ctx, func() error {
+		return g.next.PostRefund(ctx, token, paymentKey, idempotencyKey, param)
+	})
+}
+
+func (g *guardedPaymentGateway) call(ctx context.Context, f func() error) error {
+	done, err := g.breaker.allow()
+	if err != nil {
+		g.metrics.rejected.Add(1)
+		return err
+	}
+
+	select {
+	case g.limiter <- struct{}{}:
+	case <-ctx.Done():
+		done(context.Canceled)
+		return ctx.Err()
+	}
+	g.metrics.inFlight.Add(1)
+	defer func() {
+		g.metrics.inFlight.Add(-1)
+		<-g.limiter
+	}()
+
+	err = f()
+	if isPaymentGatewayFailure(err) {
+		g.metrics.failed.Add(1)
+	} else {
+		g.metrics.succeeded.Add(1)
+	}
+	done(err)
+	return err
+}
+
+// 決済マイクロサービスの障害とみなすエラーか。4xx はリクエスト側の問題なので含めない
+func isPaymentGatewayFailure(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var gatewayErr *PaymentGatewayError
+	if errors.As(err, &gatewayErr) {
+		return gatewayErr.StatusCode >= 500 || gatewayErr.StatusCode == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// 決済マイクロサービス呼び出しのエラーをレスポンスのステータスコードに変換する
+func paymentGatewayErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errPaymentGatewayUnavailable):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, erroredUpstream):
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Prometheus のテキスト形式でメトリクスを書き出す
+func writePaymentGatewayMetrics(w http.ResponseWriter) {
+	state := paymentGatewayBreaker.currentState()
+	for _, s := range []string{circuitClosed, circuitOpen, circuitHalfOpen} {
+		v := 0
+		if s == state {
+			v = 1
+		}
+		fmt.Fprintf(w, "payment_gateway_circuit_state{state=%q} %d\n", s, v)
+	}
+	fmt.Fprintf(w, "payment_gateway_in_flight_requests %d\n", paymentGatewayStats.inFlight.Load())
+	fmt.Fprintf(w, "payment_gateway_concurrency_limit %d\n", cap(paymentGatewayLimiter))
+	fmt.Fprintf(w, "payment_gateway_requests_total{result=\"succeeded\"} %d\n", paymentGatewayStats.succeeded.Load())
+	fmt.Fprintf(w, "payment_gateway_requests_total{result=\"failed\"} %d\n", paymentGatewayStats.failed.Load())
+	fmt.Fprintf(w, "payment_gateway_requests_total{result=\"rejected\"} %d\n", paymentGatewayStats.rejected.Load())
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 決済マイクロサービスの障害を再現するために、fakePaymentGateway の前に挟むクライアント
+type faultyPaymentGateway struct {
+	*fakePaymentGateway
+
+	mu sync.Mutex
+	// PostPayment ごとに先頭から1つずつ使う障害。なくなったら障害なし
+	faults []paymentFault
+	posts  int
+}
+
+type paymentFault struct {
+	err error
+	// エラーを返す前に決済を記録するか。レスポンスだけ失われた場合を再現する
+	recorded bool
+}
+
+func newFaultyPaymentGateway(faults ...paymentFault) *faultyPaymentGateway {
+	return &faultyPaymentGateway{fakePaymentGateway: newFakePaymentGateway(), faults: faults}
+}
+
+func (g *faultyPaymentGateway) fail(err error, recorded bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.faults = append(g.faults, paymentFault{err: err, recorded: recorded})
+}
+
+func (g *faultyPaymentGateway) PostPayment(ctx context.Context, token string, idempotencyKey string, param *paymentGatewayPostPaymentRequest) error {
+	g.mu.Lock()
+	fault := paymentFault{}
+	if len(g.faults) > 0 {
+		fault, g.faults = g.faults[0], g.faults[1:]
+	}
+	g.posts++
+	g.mu.Unlock()
+
+	if fault.err == nil || fault.recorded {
+		if err := g.fakePaymentGateway.PostPayment(ctx, token, idempotencyKey, param); err != nil {
+			return err
+		}
+	}
+	return fault.err
+}
+
+func (g *faultyPaymentGateway) postCount() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.posts
+}
+
+func (g *faultyPaymentGateway) recordedAmount(t *testing.T, token string, idempotencyKey string) int {
+	t.Helper()
+	payments, err := g.fakePaymentGateway.GetPayments(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	amount, count := 0, 0
+	for _, payment := range payments {
+		if payment.IdempotencyKey == idempotencyKey {
+			amount += payment.Amount
+			count++
+		}
+	}
+	if count > 1 {
+		t.Fatalf("payment %s was recorded %d times", idempotencyKey, count)
+	}
+	return amount
+}
+
+var errServiceUnavailable = &PaymentGatewayError{Method: http.MethodPost, Path: "/payments", StatusCode: http.StatusServiceUnavailable, Body: "service unavailable"}
+
+func TestRequestPaymentGatewayPostPayment(t *testing.T) {
+	tests := []struct {
+		name     string
+		postErr  error
+		recorded bool
+		wantErr  bool
+	}{
+		{name: "成功", postErr: nil, wantErr: false},
+		{name: "5xxだが決済済み", postErr: errServiceUnavailable, recorded: true, wantErr: false},
+		{name: "5xxで決済されていない", postErr: errServiceUnavailable, recorded: false, wantErr: true},
+		{name: "タイムアウトしたが決済済み", postErr: context.DeadlineExceeded, recorded: true, wantErr: false},
+		{name: "タイムアウトして決済されていない", postErr: context.DeadlineExceeded, recorded: false, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gateway := newFaultyPaymentGateway()
+			gateway.fail(tt.postErr, tt.recorded)
+
+			err := requestPaymentGatewayPostPayment(context.Background(), gateway, "token", "ride", &paymentGatewayPostPaymentRequest{Amount: 1000})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				if !errors.Is(err, erroredUpstream) {
+					t.Errorf("expected erroredUpstream, got %v", err)
+				}
+				if errors.Is(err, errPaymentNotSent) {
+					t.Errorf("a sent payment must not be reported as not sent: %v", err)
+				}
+				if amount := gateway.recordedAmount(t, "token", "ride"); amount != 0 {
+					t.Errorf("expected no payment, got %d", amount)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if amount := gateway.recordedAmount(t, "token", "ride"); amount != 1000 {
+				t.Errorf("expected 1000 to be charged, got %d", amount)
+			}
+		})
+	}
+}
+
+func TestRequestPaymentGatewayPostPaymentIsIdempotent(t *testing.T) {
+	gateway := newFaultyPaymentGateway()
+	gateway.fail(errServiceUnavailable, true)
+	if err := requestPaymentGatewayPostPayment(context.Background(), gateway, "token", "ride", &paymentGatewayPostPaymentRequest{Amount: 1000}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// 同じライドの決済をリトライしても二重に決済しない
+	gateway.fail(nil, false)
+	if err := requestPaymentGatewayPostPayment(context.Background(), gateway, "token", "ride", &paymentGatewayPostPaymentRequest{Amount: 1000}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if amount := gateway.recordedAmount(t, "token", "ride"); amount != 1000 {
+		t.Errorf("expected 1000 to be charged once, got %d", amount)
+	}
+}
+
+func TestRequestPaymentGatewayPostPaymentBreakerOpen(t *testing.T) {
+	fake := newFaultyPaymentGateway()
+	breaker := newCircuitBreaker(circuitBreakerConfig{
+		FailureThreshold: 1,
+		OpenBackoff:      time.Minute,
+		MaxOpenBackoff:   time.Minute,
+	})
+	gateway := newGuardedPaymentGateway(fake, make(chan struct{}, 1), breaker, &paymentGatewayMetrics{})
+
+	// 1回失敗してブレーカーを開く
+	fake.fail(errServiceUnavailable, false)
+	err := requestPaymentGatewayPostPayment(context.Background(), gateway, "token", "ride1", &paymentGatewayPostPaymentRequest{Amount: 1000})
+	if err == nil || errors.Is(err, errPaymentNotSent) {
+		t.Fatalf("expected a sent failure, got %v", err)
+	}
+	if state := breaker.currentState(); state != circuitOpen {
+		t.Fatalf("expected the breaker to be open, got %s", state)
+	}
+
+	fake.fail(nil, false)
+	posts := fake.postCount()
+	err = requestPaymentGatewayPostPayment(context.Background(), gateway, "token", "ride2", &paymentGatewayPostPaymentRequest{Amount: 1000})
+	if !errors.Is(err, errPaymentNotSent) {
+		t.Fatalf("expected errPaymentNotSent, got %v", err)
+	}
+	if fake.postCount() != posts {
+		t.Error("the payment must not be sent while the breaker is open")
+	}
+}
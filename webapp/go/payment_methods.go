@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var errPaymentMethodNotFound = errors.New("payment method not found")
+
+// 削除されていない決済手段を取得する
+func getPaymentMethod(ctx context.Context, tx *sqlx.Tx, userID string, paymentMethodID string) (*PaymentToken, error) {
+	paymentToken := &PaymentToken{}
+	if err := tx.GetContext(
+		ctx,
+		paymentToken,
+		"SELECT * FROM payment_tokens WHERE id = ? AND user_id = ? AND deleted_at IS NULL",
+		paymentMethodID, userID,
+	); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errPaymentMethodNotFound
+		}
+		return nil, err
+	}
+	return paymentToken, nil
+}
+
+// デフォルトの決済手段を取得する。登録されていなければ nil を返す
+func getDefaultPaymentMethod(ctx context.Context, tx *sqlx.Tx, userID string) (*PaymentToken, error) {
+	paymentToken := &PaymentToken{}
+	if err := tx.GetContext(
+		ctx,
+		paymentToken,
+		"SELECT * FROM payment_tokens WHERE user_id = ? AND deleted_at IS NULL ORDER BY is_default DESC, created_at DESC LIMIT 1",
+		userID,
+	); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return paymentToken, nil
+}
+
+func setDefaultPaymentMethod(ctx context.Context, tx *sqlx.Tx, userID string, paymentMethodID string) error {
+	_, err := tx.ExecContext(
+		ctx,
+		"UPDATE payment_tokens SET is_default = (id = ?) WHERE user_id = ? AND deleted_at IS NULL",
+		paymentMethodID, userID,
+	)
+	return err
+}
+
+// ライドの決済に使う決済手段を取得する
+// ライドに記録された決済手段を使い、記録されていなければその時点のデフォルトを記録して使う
+// 記録された決済手段がその後削除されていても、そのライドの決済には使う
+func getRidePaymentMethod(ctx context.Context, tx *sqlx.Tx, ride *Ride) (*PaymentToken, error) {
+	if ride.PaymentTokenID.Valid {
+		paymentToken := &PaymentToken{}
+		if err := tx.GetContext(ctx, paymentToken, "SELECT * FROM payment_tokens WHERE id = ?", ride.PaymentTokenID.String); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil, errPaymentMethodNotFound
+			}
+			return nil, err
+		}
+		return paymentToken, nil
+	}
+
+	paymentToken, err := getDefaultPaymentMethod(ctx, tx, ride.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if paymentToken == nil {
+		return nil, errPaymentMethodNotFound
+	}
+	if _, err := tx.ExecContext(
+		ctx,
+		"UPDATE rides SET payment_token_id = ?, updated_at = updated_at WHERE id = ?",
+		paymentToken.ID, ride.ID,
+	); err != nil {
+		return nil, err
+	}
+	ride.PaymentTokenID = sql.NullString{String: paymentToken.ID, Valid: true}
+	return paymentToken, nil
+}
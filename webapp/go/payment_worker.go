@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	paymentWorkerInterval  = 100 * time.Millisecond
+	paymentWorkerBatchSize = 20
+	// 決済を試行している間、他のワーカーが同じ決済を取らないようにする期間
+	paymentWorkerLease = 30 * time.Second
+	// リトライ間隔の上限
+	paymentWorkerMaxBackoff = time.Minute
+)
+
+// payments テーブルに積まれた決済と、結果がわからないまま残っている返金を社内決済マイクロサービスに送るワーカー
+func runPaymentWorker(ctx context.Context) {
+	ticker := time.NewTicker(paymentWorkerInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := processPendingPayments(ctx); err != nil {
+			slog.Error("failed to process pending payments", slog.Any("error", err))
+		}
+		if err := processPendingRefunds(ctx); err != nil {
+			slog.Error("failed to process pending refunds", slog.Any("error", err))
+		}
+	}
+}
+
+func processPendingPayments(ctx context.Context) error {
+	payments := []Payment{}
+	if err := db.SelectContext(
+		ctx,
+		&payments,
+		"SELECT * FROM payments WHERE status = 'pending' AND next_attempt_at <= CURRENT_TIMESTAMP(6) ORDER BY next_attempt_at LIMIT ?",
+		paymentWorkerBatchSize,
+	); err != nil {
+		return err
+	}
+	if len(payments) == 0 {
+		return nil
+	}
+	// ブレーカーが開いている間は試行回数を消費しないように何もしない
+	if paymentGatewayBreaker.currentState() == circuitOpen {
+		return nil
+	}
+
+	var paymentGatewayURL string
+	if err := db.GetContext(ctx, &paymentGatewayURL, "SELECT value FROM settings WHERE name = 'payment_gateway_url'"); err != nil {
+		return err
+	}
+	gateway := newPaymentGateway(paymentGatewayURL)
+
+	for _, payment := range payments {
+		claimed, err := claimPayment(ctx, &payment)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			continue
+		}
+		if err := settlePayment(ctx, gateway, &payment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 評価を終えたライドの決済をワーカーに積む。冪等キーにはライドIDを使う
+func newRidePayment(ride *Ride, paymentToken *PaymentToken, amount int) *Payment {
+	return &Payment{
+		ID:     ulid.Make().String(),
+		RideID: ride.ID,
+		UserID: ride.UserID,
+		Token:  paymentToken.Token,
+		Amount: amount,
+		Status: "pending",
+	}
+}
+
+// 試行回数を楽観ロックとして使い、他のワーカーより先に決済を確保する
+func claimPayment(ctx context.Context, payment *Payment) (bool, error) {
+	result, err := db.ExecContext(
+		ctx,
+		"UPDATE payments SET attempts = attempts + 1, next_attempt_at = CURRENT_TIMESTAMP(6) + INTERVAL ? SECOND WHERE id = ? AND status = 'pending' AND attempts = ?",
+		int(paymentWorkerLease.Seconds()), payment.ID, payment.Attempts,
+	)
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if count == 0 {
+		return false, nil
+	}
+	payment.Attempts++
+	return true, nil
+}
+
+// 1回の試行の結果に応じた payments の行の更新内容
+type paymentSettlement struct {
+	Status    string
+	LastError *string
+	// 送っていないので試行回数に数えない
+	NotSent bool
+	// pending のまま残すときの次の試行までの間隔
+	RetryAfter time.Duration
+}
+
+// 確保した決済を社内決済マイクロサービスに送り、結果から payments の行をどう更新するかを決める
+func attemptPayment(ctx context.Context, gateway PaymentGateway, payment *Payment) paymentSettlement {
+	// FIXME: 社内決済マイクロサービスのインフラに異常が発生していて、同時にたくさんリクエストすると変なことになる可能性あり
+	attemptErr := requestPaymentGatewayPostPayment(ctx, gateway, payment.Token, payment.RideID, &paymentGatewayPostPaymentRequest{
+		Amount: payment.Amount,
+	})
+	if attemptErr == nil {
+		return paymentSettlement{Status: "succeeded"}
+	}
+	if errors.Is(attemptErr, errPaymentNotSent) {
+		return paymentSettlement{Status: "pending", NotSent: true, RetryAfter: defaultCircuitBreakerConfig.OpenBackoff}
+	}
+
+	slog.Warn("payment attempt failed", slog.String("payment_id", payment.ID), slog.Int("attempts", payment.Attempts), slog.Any("error", attemptErr))
+
+	// 失敗したら間隔を倍にしながらリトライし、上限を超えたら諦める
+	lastError := attemptErr.Error()
+	if payment.Attempts > paymentGatewaySettings.MaxRetries {
+		return paymentSettlement{Status: "failed", LastError: &lastError}
+	}
+	return paymentSettlement{
+		Status:     "pending",
+		LastError:  &lastError,
+		RetryAfter: backoffWithJitter(paymentGatewaySettings.RetryInterval, payment.Attempts-1, paymentWorkerMaxBackoff),
+	}
+}
+
+func settlePayment(ctx context.Context, gateway PaymentGateway, payment *Payment) error {
+	settlement := attemptPayment(ctx, gateway, payment)
+	var err error
+	switch {
+	case settlement.Status != "pending":
+		_, err = db.ExecContext(ctx, "UPDATE payments SET status = ?, last_error = ? WHERE id = ?", settlement.Status, settlement.LastError, payment.ID)
+	case settlement.NotSent:
+		_, err = db.ExecContext(
+			ctx,
+			"UPDATE payments SET attempts = attempts - 1, next_attempt_at = CURRENT_TIMESTAMP(6) + INTERVAL ? MICROSECOND WHERE id = ?",
+			settlement.RetryAfter.Microseconds(), payment.ID,
+		)
+	default:
+		_, err = db.ExecContext(
+			ctx,
+			"UPDATE payments SET last_error = ?, next_attempt_at = CURRENT_TIMESTAMP(6) + INTERVAL ? MICROSECOND WHERE id = ?",
+			settlement.LastError, settlement.RetryAfter.Microseconds(), payment.ID,
+		)
+	}
+	return err
+}
+
+// 決済マイクロサービスが確かに受け付けなかったエラーか。4xx は何度送っても同じ結果になる
+func isPaymentGatewayRejection(err error) bool {
+	var gatewayErr *PaymentGatewayError
+	return errors.As(err, &gatewayErr) && gatewayErr.StatusCode >= 400 && gatewayErr.StatusCode < 500 && gatewayErr.StatusCode != http.StatusTooManyRequests
+}
+
+type pendingRefund struct {
+	Refund
+	Token string `db:"token"`
+}
+
+func processPendingRefunds(ctx context.Context) error {
+	refunds := []pendingRefund{}
+	if err := db.SelectContext(
+		ctx,
+		&refunds,
+		`SELECT refunds.*, payments.token FROM refunds JOIN payments ON payments.id = refunds.payment_id
+		 WHERE refunds.status = 'pending' AND refunds.next_attempt_at <= CURRENT_TIMESTAMP(6) ORDER BY refunds.next_attempt_at LIMIT ?`,
+		paymentWorkerBatchSize,
+	); err != nil {
+		return err
+	}
+	if len(refunds) == 0 || paymentGatewayBreaker.currentState() == circuitOpen {
+		return nil
+	}
+
+	var paymentGatewayURL string
+	if err := db.GetContext(ctx, &paymentGatewayURL, "SELECT value FROM settings WHERE name = 'payment_gateway_url'"); err != nil {
+		return err
+	}
+	gateway := newPaymentGateway(paymentGatewayURL)
+
+	for _, refund := range refunds {
+		result, err := db.ExecContext(
+			ctx,
+			"UPDATE refunds SET attempts = attempts + 1, next_attempt_at = CURRENT_TIMESTAMP(6) + INTERVAL ? SECOND WHERE id = ? AND status = 'pending' AND attempts = ?",
+			int(paymentWorkerLease.Seconds()), refund.ID, refund.Attempts,
+		)
+		if err != nil {
+			return err
+		}
+		if count, err := result.RowsAffected(); err != nil {
+			return err
+		} else if count == 0 {
+			continue
+		}
+		refund.Attempts++
+
+		attemptErr, err := settleRefund(ctx, gateway, refund.Token, &refund.Refund)
+		if err != nil {
+			return err
+		}
+		if attemptErr != nil {
+			slog.Warn("refund attempt failed", slog.String("refund_id", refund.ID), slog.Int("attempts", refund.Attempts), slog.Any("error", attemptErr))
+		}
+	}
+	return nil
+}
+
+// 返金を決済マイクロサービスに送り、結果を refunds に記録する
+// 確かに断られたときだけ failed にし、それ以外の失敗は同じ冪等キーでリトライするため pending のまま残す
+// 送った結果のエラーを attemptErr、記録に失敗したエラーを err として返す
+func settleRefund(ctx context.Context, gateway PaymentGateway, token string, refund *Refund) (attemptErr error, err error) {
+	attemptErr = gateway.PostRefund(ctx, token, refund.RideID, refund.ID, &paymentGatewayPostRefundRequest{
+		Amount: refund.Amount,
+	})
+	switch {
+	case attemptErr == nil:
+		err = completeRefund(ctx, refund)
+		refund.Status = "succeeded"
+	case isPaymentGatewayRejection(attemptErr):
+		_, err = db.ExecContext(ctx, "UPDATE refunds SET status = 'failed', last_error = ? WHERE id = ?", attemptErr.Error(), refund.ID)
+		refund.Status = "failed"
+	case errors.Is(attemptErr, errPaymentGatewayUnavailable):
+		// 送っていないので試行回数に数えない
+		_, err = db.ExecContext(
+			ctx,
+			"UPDATE refunds SET attempts = attempts - 1, last_error = ?, next_attempt_at = CURRENT_TIMESTAMP(6) + INTERVAL ? MICROSECOND WHERE id = ?",
+			attemptErr.Error(), defaultCircuitBreakerConfig.OpenBackoff.Microseconds(), refund.ID,
+		)
+	default:
+		backoff := backoffWithJitter(paymentGatewaySettings.RetryInterval, refund.Attempts-1, paymentWorkerMaxBackoff)
+		_, err = db.ExecContext(
+			ctx,
+			"UPDATE refunds SET last_error = ?, next_attempt_at = CURRENT_TIMESTAMP(6) + INTERVAL ? MICROSECOND WHERE id = ?",
+			attemptErr.Error(), backoff.Microseconds(), refund.ID,
+		)
+	}
+	return attemptErr, err
+}
+
+// 返金の成功を記録し、返金した分の売上を取り消す
+func completeRefund(ctx context.Context, refund *Refund) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "UPDATE refunds SET status = 'succeeded', last_error = NULL WHERE id = ? AND status = 'pending'", refund.ID)
+	if err != nil {
+		return err
+	}
+	// 別の試行で成功を記録済みなら二重に取り消さない
+	if count, err := result.RowsAffected(); err != nil {
+		return err
+	} else if count == 0 {
+		return nil
+	}
+	if err := postRefundLedger(ctx, tx, refund.RideID, refund.Amount); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+type paymentSettlementCase struct {
+	name   string
+	faults []paymentFault
+	// ブレーカーが1回の失敗で開くようにする
+	breakerTripsOnce bool
+
+	wantStatus   string
+	wantAttempts int
+	wantCharged  bool
+}
+
+func paymentSettlementCases() []paymentSettlementCase {
+	alwaysUnavailable := make([]paymentFault, paymentGatewaySettings.MaxRetries+1)
+	for i := range alwaysUnavailable {
+		alwaysUnavailable[i] = paymentFault{err: errServiceUnavailable}
+	}
+	return []paymentSettlementCase{
+		{name: "成功", wantStatus: "succeeded", wantAttempts: 1, wantCharged: true},
+		{name: "5xxだが決済済み", faults: []paymentFault{{err: errServiceUnavailable, recorded: true}}, wantStatus: "succeeded", wantAttempts: 1, wantCharged: true},
+		{name: "5xxで決済されずリトライで成功", faults: []paymentFault{{err: errServiceUnavailable}}, wantStatus: "succeeded", wantAttempts: 2, wantCharged: true},
+		{name: "タイムアウトしたが決済済み", faults: []paymentFault{{err: context.DeadlineExceeded, recorded: true}}, wantStatus: "succeeded", wantAttempts: 1, wantCharged: true},
+		{name: "タイムアウトして決済されずリトライで成功", faults: []paymentFault{{err: context.DeadlineExceeded}}, wantStatus: "succeeded", wantAttempts: 2, wantCharged: true},
+		{name: "リトライの上限を超えたら諦める", faults: alwaysUnavailable, wantStatus: "failed", wantAttempts: paymentGatewaySettings.MaxRetries + 1, wantCharged: false},
+		// ブレーカーが開いた後の試行は送らないので試行回数に数えない
+		{name: "ブレーカーが開いている", faults: []paymentFault{{err: errServiceUnavailable}}, breakerTripsOnce: true, wantStatus: "pending", wantAttempts: 1, wantCharged: false},
+	}
+}
+
+func (tt *paymentSettlementCase) gateway() (*faultyPaymentGateway, PaymentGateway) {
+	fake := newFaultyPaymentGateway(tt.faults...)
+	config := circuitBreakerConfig{FailureThreshold: 100, OpenBackoff: time.Millisecond, MaxOpenBackoff: time.Millisecond}
+	if tt.breakerTripsOnce {
+		config = circuitBreakerConfig{FailureThreshold: 1, OpenBackoff: time.Minute, MaxOpenBackoff: time.Minute}
+	}
+	return fake, newGuardedPaymentGateway(fake, make(chan struct{}, 1), newCircuitBreaker(config), &paymentGatewayMetrics{})
+}
+
+func (tt *paymentSettlementCase) check(t *testing.T, fake *faultyPaymentGateway, payment *Payment) {
+	t.Helper()
+	if payment.Status != tt.wantStatus || payment.Attempts != tt.wantAttempts {
+		t.Errorf("expected %s after %d attempts, got %s after %d attempts", tt.wantStatus, tt.wantAttempts, payment.Status, payment.Attempts)
+	}
+	want := 0
+	if tt.wantCharged {
+		want = payment.Amount
+	}
+	if amount := fake.recordedAmount(t, payment.Token, payment.RideID); amount != want {
+		t.Errorf("expected %d to be charged, got %d", want, amount)
+	}
+}
+
+// 評価で積んだ決済を、ワーカーと同じく確保してから試行することを決済が終わるまで繰り返す
+func TestPaymentWorkerSettlesEvaluatedRide(t *testing.T) {
+	for _, tt := range paymentSettlementCases() {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, gateway := tt.gateway()
+			ride := &Ride{ID: ulid.Make().String(), UserID: "user", DestinationLatitude: 10, DestinationLongitude: 10}
+			payment := newRidePayment(ride, &PaymentToken{Token: "token"}, calculateSale(*ride))
+			if payment.Status != "pending" || payment.Attempts != 0 || payment.RideID != ride.ID {
+				t.Fatalf("unexpected payment: %+v", payment)
+			}
+
+			for i := 0; payment.Status == "pending" && i <= paymentGatewaySettings.MaxRetries+1; i++ {
+				payment.Attempts++
+				settlement := attemptPayment(context.Background(), gateway, payment)
+				if settlement.NotSent {
+					payment.Attempts--
+				}
+				payment.Status = settlement.Status
+				payment.LastError = settlement.LastError
+			}
+			tt.check(t, fake, payment)
+		})
+	}
+}
+
+// ISUCON_TEST_DB が設定されていれば、init.sh で初期化したデータベースに対して評価のハンドラーとワーカーを動かす
+func TestPaymentWorkerSettlesEvaluatedRideWithDB(t *testing.T) {
+	if os.Getenv("ISUCON_TEST_DB") == "" {
+		t.Skip("ISUCON_TEST_DB is not set")
+	}
+	if db == nil {
+		setupDB()
+	}
+	ctx := context.Background()
+
+	for _, tt := range paymentSettlementCases() {
+		t.Run(tt.name, func(t *testing.T) {
+			ownerID, chairID, userID, paymentTokenID, rideID := ulid.Make().String(), ulid.Make().String(), ulid.Make().String(), ulid.Make().String(), ulid.Make().String()
+			t.Cleanup(func() {
+				for query, arg := range map[string]string{
+					"DELETE FROM payments WHERE ride_id = ?":       rideID,
+					"DELETE FROM ledger_entries WHERE ride_id = ?": rideID,
+					"DELETE FROM ride_sales WHERE ride_id = ?":     rideID,
+					"DELETE FROM ride_statuses WHERE ride_id = ?":  rideID,
+					"DELETE FROM rides WHERE id = ?":               rideID,
+					"DELETE FROM payment_tokens WHERE id = ?":      paymentTokenID,
+					"DELETE FROM users WHERE id = ?":               userID,
+					"DELETE FROM chairs WHERE id = ?":              chairID,
+					"DELETE FROM owners WHERE id = ?":              ownerID,
+				} {
+					if _, err := db.ExecContext(ctx, query, arg); err != nil {
+						t.Error(err)
+					}
+				}
+			})
+			// 目的地に到着して評価を待っているライド
+			for query, args := range map[string][]any{
+				"INSERT INTO owners (id, name, access_token, chair_register_token) VALUES (?, ?, ?, ?)":                                                           {ownerID, ownerID, ownerID, ownerID},
+				"INSERT INTO chairs (id, owner_id, name, model, is_active, access_token) VALUES (?, ?, ?, 'test', TRUE, ?)":                                       {chairID, ownerID, chairID, chairID},
+				"INSERT INTO users (id, username, firstname, lastname, date_of_birth, access_token, invitation_code) VALUES (?, ?, 'a', 'b', '2000-01-01', ?, ?)": {userID, userID, userID, userID},
+				"INSERT INTO payment_tokens (id, user_id, token, is_default) VALUES (?, ?, ?, TRUE)":                                                              {paymentTokenID, userID, "token-" + rideID},
+			} {
+				if _, err := db.ExecContext(ctx, query, args...); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := db.ExecContext(ctx, "INSERT INTO rides (id, user_id, chair_id, pickup_latitude, pickup_longitude, destination_latitude, destination_longitude) VALUES (?, ?, ?, 0, 0, 10, 10)", rideID, userID, chairID); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, 'ARRIVED')", ulid.Make().String(), rideID); err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/api/app/rides/"+rideID+"/evaluation", strings.NewReader(`{"evaluation":5}`))
+			req.SetPathValue("ride_id", rideID)
+			rec := httptest.NewRecorder()
+			appPostRideEvaluatation(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body.String())
+			}
+
+			fake, gateway := tt.gateway()
+			payment := &Payment{}
+			if err := db.GetContext(ctx, payment, "SELECT * FROM payments WHERE ride_id = ?", rideID); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; payment.Status == "pending" && i <= paymentGatewaySettings.MaxRetries+1; i++ {
+				claimed, err := claimPayment(ctx, payment)
+				if err != nil || !claimed {
+					t.Fatalf("failed to claim the payment: %v", err)
+				}
+				if err := settlePayment(ctx, gateway, payment); err != nil {
+					t.Fatal(err)
+				}
+				// 待たずに次の試行をする
+				if _, err := db.ExecContext(ctx, "UPDATE payments SET next_attempt_at = CURRENT_TIMESTAMP(6) WHERE id = ?", payment.ID); err != nil {
+					t.Fatal(err)
+				}
+				if err := db.GetContext(ctx, payment, "SELECT * FROM payments WHERE id = ?", payment.ID); err != nil {
+					t.Fatal(err)
+				}
+			}
+			tt.check(t, fake, payment)
+		})
+	}
+}
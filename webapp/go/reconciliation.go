@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"os"
+	"slices"
+	"time"
+)
+
+type reconciliationReport struct {
+	CheckedTokens int                   `json:"checked_tokens"`
+	CheckedRides  int                   `json:"checked_rides"`
+	Missing       []reconciliationIssue `json:"missing"`
+	Duplicates    []reconciliationIssue `json:"duplicates"`
+	Mismatched    []reconciliationIssue `json:"mismatched"`
+	Unexpected    []reconciliationIssue `json:"unexpected"`
+	Enqueued      int                   `json:"enqueued"`
+	StartedAt     int64                 `json:"started_at"`
+	FinishedAt    int64                 `json:"finished_at"`
+}
+
+type reconciliationIssue struct {
+	UserID         string `json:"user_id"`
+	RideID         string `json:"ride_id,omitempty"`
+	ExpectedAmount int    `json:"expected_amount"`
+	ChargedAmounts []int  `json:"charged_amounts"`
+	RefundedAmount int    `json:"refunded_amount,omitempty"`
+	PaymentStatus  string `json:"payment_status,omitempty"`
+}
+
+// 完了したライドが正しい金額でちょうど1回ずつ決済されているかを、決済トークンごとに社内決済マイクロサービスと突き合わせる
+// 決済マイクロサービスの返金済みの額を差し引いた額と、記録した請求額から返金済みの額を差し引いた額を比べる
+// enqueue が true なら、決済に失敗したまま決済されていないライドを payments に積み直す
+// payments に行が無いライド (決済のアウトボックス導入前のライドなど) は報告するだけで積み直さない
+func reconcilePayments(ctx context.Context, gateway PaymentGateway, enqueue bool) (*reconciliationReport, error) {
+	report := &reconciliationReport{
+		Missing:    []reconciliationIssue{},
+		Duplicates: []reconciliationIssue{},
+		Mismatched: []reconciliationIssue{},
+		Unexpected: []reconciliationIssue{},
+		StartedAt:  time.Now().UnixMilli(),
+	}
+
+	// 同じトークンが複数の決済手段として登録されていることがあるので、トークン単位でまとめて突き合わせる
+	// 削除された決済手段も過去のライドの決済に使われているので含める
+	paymentTokens := []reconciliationPaymentToken{}
+	if err := db.SelectContext(ctx, &paymentTokens, "SELECT token, MIN(user_id) AS user_id FROM payment_tokens GROUP BY token ORDER BY user_id"); err != nil {
+		return nil, err
+	}
+
+	for _, paymentToken := range paymentTokens {
+		if err := reconcilePaymentToken(ctx, gateway, &paymentToken, enqueue, report); err != nil {
+			return nil, err
+		}
+		report.CheckedTokens++
+	}
+
+	report.FinishedAt = time.Now().UnixMilli()
+	return report, nil
+}
+
+type reconciliationPaymentToken struct {
+	Token  string `db:"token"`
+	UserID string `db:"user_id"`
+}
+
+func reconcilePaymentToken(ctx context.Context, gateway PaymentGateway, paymentToken *reconciliationPaymentToken, enqueue bool, report *reconciliationReport) error {
+	charged, err := gateway.GetPayments(ctx, paymentToken.Token)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// 請求すべき額はライドの完了時に ride_sales に記録した額とする
+	// 運賃やクーポンを後から変更しても過去のライドの請求額は変わらない
+	rides := []struct {
+		Ride
+		Charged sql.NullInt64 `db:"charged"`
+	}{}
+	if err := tx.SelectContext(
+		ctx,
+		&rides,
+		`SELECT rides.*, ride_sales.charged FROM rides
+		 JOIN payment_tokens ON payment_tokens.id = rides.payment_token_id
+		 LEFT JOIN ride_sales ON ride_sales.ride_id = rides.id
+		 WHERE payment_tokens.token = ? AND EXISTS (SELECT 1 FROM ride_statuses WHERE ride_id = rides.id AND status = 'COMPLETED') ORDER BY rides.created_at`,
+		paymentToken.Token,
+	); err != nil {
+		return err
+	}
+
+	payments := []Payment{}
+	if err := tx.SelectContext(ctx, &payments, "SELECT * FROM payments WHERE token = ?", paymentToken.Token); err != nil {
+		return err
+	}
+	paymentByRideID := make(map[string]*Payment, len(payments))
+	for i := range payments {
+		paymentByRideID[payments[i].RideID] = &payments[i]
+	}
+
+	refunds := []struct {
+		RideID string `db:"ride_id"`
+		Amount int    `db:"amount"`
+	}{}
+	if err := tx.SelectContext(
+		ctx,
+		&refunds,
+		"SELECT r.ride_id, SUM(r.amount) AS amount FROM refunds r JOIN payments p ON p.id = r.payment_id WHERE p.token = ? AND r.status = 'succeeded' GROUP BY r.ride_id",
+		paymentToken.Token,
+	); err != nil {
+		return err
+	}
+	refundedByRideID := make(map[string]int, len(refunds))
+	for _, refund := range refunds {
+		refundedByRideID[refund.RideID] = refund.Amount
+	}
+
+	chargedByKey := map[string][]paymentGatewayGetPaymentsResponseOne{}
+	unkeyed := []int{}
+	for _, c := range charged {
+		if c.IdempotencyKey == "" {
+			unkeyed = append(unkeyed, c.Amount)
+		} else {
+			chargedByKey[c.IdempotencyKey] = append(chargedByKey[c.IdempotencyKey], c)
+		}
+	}
+
+	for _, ride := range rides {
+		report.CheckedRides++
+
+		payment := paymentByRideID[ride.ID]
+		expected := int(ride.Charged.Int64)
+		if !ride.Charged.Valid {
+			// 売上を記録していないライドは積んだ決済の額で突き合わせる
+			if payment == nil {
+				continue
+			}
+			expected = payment.Amount
+		}
+		issue := reconciliationIssue{
+			UserID:         ride.UserID,
+			RideID:         ride.ID,
+			ExpectedAmount: expected,
+			ChargedAmounts: []int{},
+			RefundedAmount: refundedByRideID[ride.ID],
+		}
+		if payment != nil {
+			issue.PaymentStatus = payment.Status
+		}
+		// 返金済みの額を差し引いた、実際に決済されているべき額
+		// 請求漏れを積み直すときもこの額で決済するので、積み直した決済もこの額と比べる
+		shouldCharge := expected - issue.RefundedAmount
+		charges := chargedByKey[ride.ID]
+		for _, c := range charges {
+			issue.ChargedAmounts = append(issue.ChargedAmounts, c.Amount)
+		}
+		delete(chargedByKey, ride.ID)
+
+		switch {
+		case len(charges) == 0:
+			// 冪等キー導入前の決済は金額で突き合わせる
+			if i := slices.Index(unkeyed, expected); i >= 0 {
+				unkeyed = slices.Delete(unkeyed, i, i+1)
+				continue
+			}
+			// ワーカーが決済中のものは問題としない
+			if payment != nil && payment.Status == "pending" {
+				continue
+			}
+			// 全額返金したライドは請求しなくてよい
+			if shouldCharge <= 0 {
+				continue
+			}
+			report.Missing = append(report.Missing, issue)
+			// 決済に成功したはずの行は調べる必要があるので報告だけにとどめ、失敗した行だけを積み直す
+			if enqueue && payment != nil && payment.Status == "failed" {
+				if _, err := db.ExecContext(
+					ctx,
+					"UPDATE payments SET status = 'pending', attempts = 0, last_error = NULL, next_attempt_at = CURRENT_TIMESTAMP(6), amount = ? WHERE id = ?",
+					shouldCharge, payment.ID,
+				); err != nil {
+					return err
+				}
+				report.Enqueued++
+			}
+		case len(charges) > 1:
+			report.Duplicates = append(report.Duplicates, issue)
+		case charges[0].Amount-charges[0].RefundedAmount != shouldCharge:
+			report.Mismatched = append(report.Mismatched, issue)
+		}
+	}
+
+	// どのライドにも対応しない決済
+	for key, charges := range chargedByKey {
+		amounts := make([]int, 0, len(charges))
+		for _, c := range charges {
+			amounts = append(amounts, c.Amount)
+		}
+		report.Unexpected = append(report.Unexpected, reconciliationIssue{
+			UserID:         paymentToken.UserID,
+			RideID:         key,
+			ChargedAmounts: amounts,
+		})
+	}
+	if len(unkeyed) > 0 {
+		report.Unexpected = append(report.Unexpected, reconciliationIssue{
+			UserID:         paymentToken.UserID,
+			ChargedAmounts: unkeyed,
+		})
+	}
+
+	return tx.Commit()
+}
+
+// ISUCON_RECONCILE_INTERVAL (例: 1h) が設定されていれば定期的に突き合わせを行う
+// ISUCON_RECONCILE_ENQUEUE=1 なら決済されていないライドを積み直す
+func runReconciliationJob(ctx context.Context) {
+	v := os.Getenv("ISUCON_RECONCILE_INTERVAL")
+	if v == "" {
+		return
+	}
+	interval, err := time.ParseDuration(v)
+	if err != nil || interval <= 0 {
+		slog.Error("invalid ISUCON_RECONCILE_INTERVAL", slog.String("value", v))
+		return
+	}
+	enqueue := os.Getenv("ISUCON_RECONCILE_ENQUEUE") == "1"
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var paymentGatewayURL string
+		if err := db.GetContext(ctx, &paymentGatewayURL, "SELECT value FROM settings WHERE name = 'payment_gateway_url'"); err != nil {
+			slog.Error("failed to reconcile payments", slog.Any("error", err))
+			continue
+		}
+		report, err := reconcilePayments(ctx, newPaymentGateway(paymentGatewayURL), enqueue)
+		if err != nil {
+			slog.Error("failed to reconcile payments", slog.Any("error", err))
+			continue
+		}
+		slog.Info("payments reconciled",
+			slog.Int("checked_rides", report.CheckedRides),
+			slog.Int("missing", len(report.Missing)),
+			slog.Int("duplicates", len(report.Duplicates)),
+			slog.Int("mismatched", len(report.Mismatched)),
+			slog.Int("unexpected", len(report.Unexpected)),
+			slog.Int("enqueued", report.Enqueued),
+		)
+	}
+}
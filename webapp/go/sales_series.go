@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+	_ "time/tzdata"
+)
+
+var salesGranularities = []string{"hour", "day", "week", "month"}
+
+// 売上の時系列の1区間
+type salesBucket struct {
+	// 区間の開始日時
+	Start int64 `json:"start"`
+	Sales int   `json:"sales"`
+	// 区間中に返金した額。売上の集計と同じく返金した日時の区間に計上する
+	Refund int                `json:"refund"`
+	Rides  int                `json:"rides"`
+	Chairs []salesBucketChair `json:"chairs"`
+	Models []salesBucketModel `json:"models"`
+}
+
+type salesBucketChair struct {
+	ID     string `json:"id"`
+	Sales  int    `json:"sales"`
+	Refund int    `json:"refund"`
+	Rides  int    `json:"rides"`
+}
+
+type salesBucketModel struct {
+	Model  string `json:"model"`
+	Sales  int    `json:"sales"`
+	Refund int    `json:"refund"`
+	Rides  int    `json:"rides"`
+}
+
+// 指定したタイムゾーンの暦に沿って、時刻を含む区間の開始日時を求める
+// 週は月曜日から始まる
+// 時間単位は、夏時間の終わりに同じ時刻が2回あってもそれぞれ別の区間になるよう、絶対時刻のまま分以下を切り捨てる
+func truncateToBucket(t time.Time, granularity string, loc *time.Location) time.Time {
+	t = t.In(loc)
+	y, m, d := t.Date()
+	switch granularity {
+	case "hour":
+		return t.Add(-time.Duration(t.Minute())*time.Minute - time.Duration(t.Second())*time.Second - time.Duration(t.Nanosecond()))
+	case "week":
+		return time.Date(y, m, d-(int(t.Weekday())+6)%7, 0, 0, 0, 0, loc)
+	case "month":
+		return time.Date(y, m, 1, 0, 0, 0, 0, loc)
+	default:
+		return time.Date(y, m, d, 0, 0, 0, 0, loc)
+	}
+}
+
+func nextBucket(start time.Time, granularity string) time.Time {
+	switch granularity {
+	case "hour":
+		return start.Add(time.Hour)
+	case "week":
+		return start.AddDate(0, 0, 7)
+	case "month":
+		return start.AddDate(0, 1, 0)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
+
+type salesSeriesBuilder struct {
+	granularity string
+	loc         *time.Location
+	buckets     map[int64]*salesBucket
+	chairs      map[int64]map[string]*salesBucketChair
+	models      map[int64]map[string]*salesBucketModel
+}
+
+func newSalesSeriesBuilder(granularity string, timezone string) (*salesSeriesBuilder, error) {
+	if !slices.Contains(salesGranularities, granularity) {
+		return nil, fmt.Errorf("granularity must be one of %v", salesGranularities)
+	}
+	if timezone == "" {
+		timezone = "UTC"
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone: %w", err)
+	}
+	return &salesSeriesBuilder{
+		granularity: granularity,
+		loc:         loc,
+		buckets:     map[int64]*salesBucket{},
+		chairs:      map[int64]map[string]*salesBucketChair{},
+		models:      map[int64]map[string]*salesBucketModel{},
+	}, nil
+}
+
+// 時刻を含む区間と、その区間の椅子とモデルの集計を返す。なければ作る
+func (b *salesSeriesBuilder) entries(chair *Chair, at time.Time) (*salesBucket, *salesBucketChair, *salesBucketModel) {
+	key := truncateToBucket(at, b.granularity, b.loc).UnixMilli()
+	bucket, ok := b.buckets[key]
+	if !ok {
+		bucket = &salesBucket{Start: key}
+		b.buckets[key] = bucket
+		b.chairs[key] = map[string]*salesBucketChair{}
+		b.models[key] = map[string]*salesBucketModel{}
+	}
+	c, ok := b.chairs[key][chair.ID]
+	if !ok {
+		c = &salesBucketChair{ID: chair.ID}
+		b.chairs[key][chair.ID] = c
+	}
+	m, ok := b.models[key][chair.Model]
+	if !ok {
+		m = &salesBucketModel{Model: chair.Model}
+		b.models[key][chair.Model] = m
+	}
+	return bucket, c, m
+}
+
+func (b *salesSeriesBuilder) add(chair *Chair, at time.Time, sales int) {
+	bucket, c, m := b.entries(chair, at)
+	bucket.Sales += sales
+	bucket.Rides++
+	c.Sales += sales
+	c.Rides++
+	m.Sales += sales
+	m.Rides++
+}
+
+func (b *salesSeriesBuilder) addRefund(chair *Chair, at time.Time, amount int) {
+	bucket, c, m := b.entries(chair, at)
+	bucket.Refund += amount
+	c.Refund += amount
+	m.Refund += amount
+}
+
+// 最初と最後の売上がある区間の間を、売上がない区間も含めて時系列順に返す
+func (b *salesSeriesBuilder) build() []salesBucket {
+	series := []salesBucket{}
+	if len(b.buckets) == 0 {
+		return series
+	}
+
+	keys := make([]int64, 0, len(b.buckets))
+	for key := range b.buckets {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	last := keys[len(keys)-1]
+	for start := time.UnixMilli(keys[0]).In(b.loc); start.UnixMilli() <= last; start = nextBucket(start, b.granularity) {
+		key := start.UnixMilli()
+		bucket, ok := b.buckets[key]
+		if !ok {
+			series = append(series, salesBucket{
+				Start:  key,
+				Chairs: []salesBucketChair{},
+				Models: []salesBucketModel{},
+			})
+			continue
+		}
+
+		bucket.Chairs = make([]salesBucketChair, 0, len(b.chairs[key]))
+		for _, c := range b.chairs[key] {
+			bucket.Chairs = append(bucket.Chairs, *c)
+		}
+		slices.SortFunc(bucket.Chairs, func(a, b salesBucketChair) int { return strings.Compare(a.ID, b.ID) })
+		bucket.Models = make([]salesBucketModel, 0, len(b.models[key]))
+		for _, m := range b.models[key] {
+			bucket.Models = append(bucket.Models, *m)
+		}
+		slices.SortFunc(bucket.Models, func(a, b salesBucketModel) int { return strings.Compare(a.Model, b.Model) })
+
+		series = append(series, *bucket)
+	}
+	return series
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+// 位置情報が途絶えた椅子を探す間隔
+const staleChairCheckInterval = 10 * time.Second
+
+// 受付中の椅子が位置情報を送らなくなってから停止するまでの時間を settings から取得する。0 なら停止しない
+func getChairHeartbeatTimeout(ctx context.Context) (time.Duration, error) {
+	var value string
+	if err := db.GetContext(ctx, &value, "SELECT value FROM settings WHERE name = 'chair_heartbeat_timeout'"); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid setting chair_heartbeat_timeout: %w", err)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// 椅子が最後に位置情報を送った日時。chair_distances がまだない椅子は chair_locations から求める
+// chairs を c、chair_distances を cd として結合したクエリで使う
+const chairLastLocationAt = `IFNULL(cd.updated_at, (SELECT MAX(created_at) FROM chair_locations WHERE chair_id = c.id))`
+
+// 椅子が最後に位置情報を送った日時。受付を始めたのがそれより後なら受付を始めた日時
+const chairLastSeenAt = `GREATEST(
+  IFNULL(` + chairLastLocationAt + `, c.created_at),
+  IFNULL((SELECT MAX(created_at) FROM chair_activities WHERE chair_id = c.id), c.created_at)
+)`
+
+type staleChairSummary struct {
+	ChairID      string
+	FlaggedRides int
+}
+
+// 最後に位置情報を送ってから timeout 以上経った受付中の椅子を停止する
+// 停止した椅子のオーナーに通知し、走行中のライドはサポートの対応が必要なものとして記録する
+func deactivateStaleChairs(ctx context.Context, timeout time.Duration) ([]staleChairSummary, error) {
+	staleChairIDs := []string{}
+	if err := db.SelectContext(
+		ctx,
+		&staleChairIDs,
+		"SELECT c.id FROM chairs c LEFT JOIN chair_distances cd ON cd.chair_id = c.id WHERE c.is_active = TRUE AND "+chairLastSeenAt+" < CURRENT_TIMESTAMP(6) - INTERVAL ? MICROSECOND",
+		timeout.Microseconds(),
+	); err != nil {
+		return nil, err
+	}
+
+	summaries := []staleChairSummary{}
+	for _, chairID := range staleChairIDs {
+		summary, err := deactivateStaleChair(ctx, chairID, timeout)
+		if err != nil {
+			return summaries, err
+		}
+		if summary != nil {
+			summaries = append(summaries, *summary)
+		}
+	}
+	return summaries, nil
+}
+
+func deactivateStaleChair(ctx context.Context, chairID string, timeout time.Duration) (*staleChairSummary, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	chair := &Chair{}
+	if err := tx.GetContext(ctx, chair, "SELECT * FROM chairs WHERE id = ? FOR UPDATE", chairID); err != nil {
+		return nil, err
+	}
+	// 探してからロックするまでの間に位置情報が届いていれば停止しない
+	lastSeen := struct {
+		LastSeenAt     time.Time    `db:"last_seen_at"`
+		LastLocationAt sql.NullTime `db:"last_location_at"`
+	}{}
+	if err := tx.GetContext(
+		ctx,
+		&lastSeen,
+		"SELECT "+chairLastSeenAt+" AS last_seen_at, "+chairLastLocationAt+" AS last_location_at FROM chairs c LEFT JOIN chair_distances cd ON cd.chair_id = c.id WHERE c.id = ?",
+		chair.ID,
+	); err != nil {
+		return nil, err
+	}
+	if !chair.IsActive || time.Since(lastSeen.LastSeenAt) < timeout {
+		return nil, nil
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE chairs SET is_active = FALSE WHERE id = ?", chair.ID); err != nil {
+		return nil, err
+	}
+	if err := recordChairActivity(ctx, tx, chair.ID, false, chairActivityReasonStale); err != nil {
+		return nil, err
+	}
+
+	detail := "no coordinate received since activation"
+	if lastSeen.LastLocationAt.Valid {
+		detail = fmt.Sprintf("no coordinate received since %s", lastSeen.LastLocationAt.Time.UTC().Format(time.RFC3339))
+	}
+	if _, err := tx.ExecContext(
+		ctx,
+		"INSERT INTO owner_notifications (id, owner_id, chair_id, type, message) VALUES (?, ?, ?, ?, ?)",
+		ulid.Make().String(), chair.OwnerID, chair.ID, "chair_stale",
+		fmt.Sprintf("椅子 %s からの位置情報が途絶えたため、配車の受付を停止しました。位置情報が届けば受付を再開します (%s)", chair.Name, detail),
+	); err != nil {
+		return nil, err
+	}
+
+	rideIDs := []string{}
+	if err := tx.SelectContext(
+		ctx,
+		&rideIDs,
+		`SELECT id FROM rides r
+		 WHERE r.chair_id = ?
+		   AND NOT EXISTS (SELECT 1 FROM ride_statuses WHERE ride_id = r.id AND status = 'COMPLETED')
+		   AND NOT EXISTS (SELECT 1 FROM ride_support_flags WHERE ride_id = r.id AND reason = 'chair_stale' AND resolved_at IS NULL)`,
+		chair.ID,
+	); err != nil {
+		return nil, err
+	}
+	for _, rideID := range rideIDs {
+		if _, err := tx.ExecContext(
+			ctx,
+			"INSERT INTO ride_support_flags (id, ride_id, chair_id, reason, detail) VALUES (?, ?, ?, ?, ?)",
+			ulid.Make().String(), rideID, chair.ID, "chair_stale", detail,
+		); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	cacheDeleteChair(chair.AccessToken)
+
+	return &staleChairSummary{ChairID: chair.ID, FlaggedRides: len(rideIDs)}, nil
+}
+
+// 位置情報が途絶えて自動で停止した椅子から位置情報が届いたら受付を再開する
+// 椅子自身やオーナーが停止した椅子は再開しない
+func reactivateStaleChair(ctx context.Context, tx *sqlx.Tx, chairID string) (bool, error) {
+	chair := &Chair{}
+	if err := tx.GetContext(ctx, chair, "SELECT * FROM chairs WHERE id = ? FOR UPDATE", chairID); err != nil {
+		return false, err
+	}
+	if chair.IsActive || chair.SuspendedAt != nil || chair.RetiredAt != nil {
+		return false, nil
+	}
+	var reason string
+	if err := tx.GetContext(ctx, &reason, "SELECT reason FROM chair_activities WHERE chair_id = ? ORDER BY created_at DESC, id DESC LIMIT 1", chair.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	if reason != chairActivityReasonStale {
+		return false, nil
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE chairs SET is_active = TRUE WHERE id = ?", chair.ID); err != nil {
+		return false, err
+	}
+	if err := recordChairActivity(ctx, tx, chair.ID, true, chairActivityReasonResumed); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// 位置情報が途絶えた椅子を定期的に停止する。chair_heartbeat_timeout が 0 の間は何もしない
+func runStaleChairJob(ctx context.Context) {
+	ticker := time.NewTicker(staleChairCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		timeout, err := getChairHeartbeatTimeout(ctx)
+		if err != nil {
+			slog.Error("failed to check stale chairs", slog.Any("error", err))
+			continue
+		}
+		if timeout <= 0 {
+			continue
+		}
+		summaries, err := deactivateStaleChairs(ctx, timeout)
+		if err != nil {
+			slog.Error("failed to check stale chairs", slog.Any("error", err))
+		}
+		for _, summary := range summaries {
+			slog.Info("stale chair deactivated",
+				slog.String("chair_id", summary.ChairID),
+				slog.Int("flagged_rides", summary.FlaggedRides),
+			)
+		}
+	}
+}
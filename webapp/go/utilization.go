@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"time"
+)
+
+type utilizationMetrics struct {
+	// 受付中で、ライドを担当していなかった時間
+	IdleActiveMs int64 `json:"idle_active_ms"`
+	// 配車位置に向かっていた時間 (ENROUTE -> PICKUP)
+	EnRouteMs int64 `json:"en_route_ms"`
+	// 利用者を乗せていた時間 (CARRYING -> ARRIVED)
+	CarryingMs int64 `json:"carrying_ms"`
+	// 受付中だった時間
+	ActiveMs int64 `json:"active_ms"`
+	// 割り当てから椅子が受諾するまでの時間 (matched_at -> ENROUTE) の平均
+	AvgAcceptanceLatencyMs *int64  `json:"avg_acceptance_latency_ms"`
+	CompletedRides         int     `json:"completed_rides"`
+	RidesPerActiveHour     float64 `json:"rides_per_active_hour"`
+
+	acceptanceLatencySum   int64
+	acceptanceLatencyCount int64
+}
+
+func (m *utilizationMetrics) add(o *utilizationMetrics) {
+	m.EnRouteMs += o.EnRouteMs
+	m.CarryingMs += o.CarryingMs
+	m.ActiveMs += o.ActiveMs
+	m.CompletedRides += o.CompletedRides
+	m.acceptanceLatencySum += o.acceptanceLatencySum
+	m.acceptanceLatencyCount += o.acceptanceLatencyCount
+}
+
+func (m *utilizationMetrics) finish() {
+	m.IdleActiveMs = max(m.ActiveMs-m.EnRouteMs-m.CarryingMs, 0)
+	if m.acceptanceLatencyCount > 0 {
+		avg := m.acceptanceLatencySum / m.acceptanceLatencyCount
+		m.AvgAcceptanceLatencyMs = &avg
+	}
+	if m.ActiveMs > 0 {
+		m.RidesPerActiveHour = float64(m.CompletedRides) / (float64(m.ActiveMs) / float64(time.Hour.Milliseconds()))
+	}
+}
+
+type chairUtilization struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Model string `json:"model"`
+	// 受付状態が短時間に何度も切り替わっている
+	Flapping bool `json:"flapping"`
+	utilizationMetrics
+}
+
+type modelUtilization struct {
+	Model string `json:"model"`
+	utilizationMetrics
+}
+
+type ownerUtilizationResponse struct {
+	Chairs []chairUtilization `json:"chairs"`
+	Models []modelUtilization `json:"models"`
+}
+
+// 期間中のライドの状態遷移と受付中の時間から、椅子ごと・モデルごとの稼働状況を求める
+func getOwnerUtilization(ctx context.Context, ownerID string, since, until time.Time) (*ownerUtilizationResponse, error) {
+	chairs := []Chair{}
+	if err := db.SelectContext(ctx, &chairs, "SELECT * FROM chairs WHERE owner_id = ? ORDER BY created_at", ownerID); err != nil {
+		return nil, err
+	}
+	metricsByChairID := make(map[string]*utilizationMetrics, len(chairs))
+	for _, chair := range chairs {
+		metricsByChairID[chair.ID] = &utilizationMetrics{}
+	}
+
+	rides := []struct {
+		ChairID     string       `db:"chair_id"`
+		MatchedAt   sql.NullTime `db:"matched_at"`
+		EnRouteAt   sql.NullTime `db:"enroute_at"`
+		PickupAt    sql.NullTime `db:"pickup_at"`
+		CarryingAt  sql.NullTime `db:"carrying_at"`
+		ArrivedAt   sql.NullTime `db:"arrived_at"`
+		CompletedAt sql.NullTime `db:"completed_at"`
+	}{}
+	if err := db.SelectContext(
+		ctx,
+		&rides,
+		`SELECT r.chair_id, r.matched_at,
+		        MAX(CASE WHEN rs.status = 'ENROUTE' THEN rs.created_at END) AS enroute_at,
+		        MAX(CASE WHEN rs.status = 'PICKUP' THEN rs.created_at END) AS pickup_at,
+		        MAX(CASE WHEN rs.status = 'CARRYING' THEN rs.created_at END) AS carrying_at,
+		        MAX(CASE WHEN rs.status = 'ARRIVED' THEN rs.created_at END) AS arrived_at,
+		        MAX(CASE WHEN rs.status = 'COMPLETED' THEN rs.created_at END) AS completed_at
+		 FROM rides r
+		 JOIN chairs c ON c.id = r.chair_id
+		 JOIN ride_statuses rs ON rs.ride_id = r.id
+		 WHERE c.owner_id = ? AND r.created_at <= ? + INTERVAL 999 MICROSECOND
+		 GROUP BY r.id, r.chair_id, r.matched_at
+		 HAVING completed_at IS NULL OR completed_at >= ?`,
+		ownerID, until, since,
+	); err != nil {
+		return nil, err
+	}
+	// 期間をまたぐライドは受付中の時間と同じく期間内の部分だけを数える
+	periodEnd := until
+	if now := time.Now(); periodEnd.After(now) {
+		periodEnd = now
+	}
+	inPeriod := func(t sql.NullTime) bool {
+		return t.Valid && !t.Time.Before(since) && !t.Time.After(until)
+	}
+	for _, ride := range rides {
+		m, ok := metricsByChairID[ride.ChairID]
+		if !ok {
+			continue
+		}
+		m.EnRouteMs += clipToPeriodMs(ride.EnRouteAt, ride.PickupAt, since, periodEnd)
+		m.CarryingMs += clipToPeriodMs(ride.CarryingAt, ride.ArrivedAt, since, periodEnd)
+		if ride.MatchedAt.Valid && inPeriod(ride.EnRouteAt) {
+			m.acceptanceLatencySum += ride.EnRouteAt.Time.Sub(ride.MatchedAt.Time).Milliseconds()
+			m.acceptanceLatencyCount++
+		}
+		if inPeriod(ride.CompletedAt) {
+			m.CompletedRides++
+		}
+	}
+
+	// 受付中だった時間は受付状態の変更履歴から求める
+	chairIDs := make([]string, 0, len(chairs))
+	for _, chair := range chairs {
+		chairIDs = append(chairIDs, chair.ID)
+	}
+	activitiesByChairID, err := getChairActivities(ctx, chairIDs, since, until)
+	if err != nil {
+		return nil, err
+	}
+	flapping := make(map[string]bool, len(chairs))
+	for _, chair := range chairs {
+		summary := summarizeChairActivities(activitiesByChairID[chair.ID], since, until)
+		metricsByChairID[chair.ID].ActiveMs = summary.OnlineMs
+		flapping[chair.ID] = summary.Flapping
+	}
+
+	res := &ownerUtilizationResponse{
+		Chairs: make([]chairUtilization, 0, len(chairs)),
+		Models: []modelUtilization{},
+	}
+	metricsByModel := map[string]*utilizationMetrics{}
+	for _, chair := range chairs {
+		m := metricsByChairID[chair.ID]
+		if metricsByModel[chair.Model] == nil {
+			metricsByModel[chair.Model] = &utilizationMetrics{}
+		}
+		metricsByModel[chair.Model].add(m)
+		m.finish()
+		res.Chairs = append(res.Chairs, chairUtilization{
+			ID:                 chair.ID,
+			Name:               chair.Name,
+			Model:              chair.Model,
+			Flapping:           flapping[chair.ID],
+			utilizationMetrics: *m,
+		})
+	}
+	for model, m := range metricsByModel {
+		m.finish()
+		res.Models = append(res.Models, modelUtilization{
+			Model:              model,
+			utilizationMetrics: *m,
+		})
+	}
+	sort.Slice(res.Models, func(i, j int) bool { return res.Models[i].Model < res.Models[j].Model })
+	return res, nil
+}
+
+// start から end までのうち期間内の長さ。end がまだなければ期間の終わりまで続いているものとする
+func clipToPeriodMs(start, end sql.NullTime, since, until time.Time) int64 {
+	if !start.Valid {
+		return 0
+	}
+	from := start.Time
+	if from.Before(since) {
+		from = since
+	}
+	to := until
+	if end.Valid && end.Time.Before(until) {
+		to = end.Time
+	}
+	if !to.After(from) {
+		return 0
+	}
+	return to.Sub(from).Milliseconds()
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+// 障害の種類
+const (
+	// 決済を記録したうえで 500 を返す
+	faultModeRecorded5xx = "5xx_recorded"
+	// 決済を記録せずに 500 を返す
+	faultModeUnrecorded5xx = "5xx_unrecorded"
+	// 決済を記録せずに 429 と Retry-After を返す
+	faultModeRateLimit = "rate_limit"
+	// 決済を記録したうえで、クライアントが諦めるまで応答しない
+	faultModeTimeout = "timeout"
+	// 決済を記録せずにコネクションを切断する
+	faultModeReset = "reset"
+)
+
+var faultModes = []string{faultModeRecorded5xx, faultModeUnrecorded5xx, faultModeRateLimit, faultModeTimeout, faultModeReset}
+
+// 障害注入の設定。ローカルで決済のリトライや突き合わせを試すために使う
+type FaultProfile struct {
+	// すべてのリクエストに加える遅延
+	LatencyMS int `json:"latency_ms"`
+	// 遅延に加えるばらつきの上限
+	LatencyJitterMS int `json:"latency_jitter_ms"`
+	// 障害の種類。空なら障害を起こさない
+	Mode string `json:"mode"`
+	// 障害を起こす確率 (0.0 - 1.0)
+	Rate float64 `json:"rate"`
+	// rate_limit で返す Retry-After 秒数
+	RetryAfterSeconds int `json:"retry_after_seconds"`
+	// timeout で応答を保留する最大時間
+	TimeoutMS int `json:"timeout_ms"`
+}
+
+func (p *FaultProfile) validate() error {
+	if p.LatencyMS < 0 || p.LatencyJitterMS < 0 || p.RetryAfterSeconds < 0 || p.TimeoutMS < 0 {
+		return fmt.Errorf("負の値は指定できません")
+	}
+	if p.Rate < 0 || p.Rate > 1 {
+		return fmt.Errorf("rate は 0 から 1 の間で指定してください")
+	}
+	if p.Mode == "" {
+		return nil
+	}
+	for _, mode := range faultModes {
+		if p.Mode == mode {
+			return nil
+		}
+	}
+	return fmt.Errorf("不明な mode です: %s", p.Mode)
+}
+
+var defaultFaultProfile = FaultProfile{RetryAfterSeconds: 1, TimeoutMS: 30_000}
+
+var (
+	faultProfile     = defaultFaultProfile
+	faultProfileLock sync.RWMutex
+)
+
+// 環境変数から障害注入の初期設定を読み込む
+// PAYMENT_MOCK_LATENCY_MS, PAYMENT_MOCK_LATENCY_JITTER_MS, PAYMENT_MOCK_FAULT_MODE,
+// PAYMENT_MOCK_FAULT_RATE, PAYMENT_MOCK_RETRY_AFTER, PAYMENT_MOCK_TIMEOUT_MS
+func loadFaultProfileFromEnv() error {
+	p := faultProfile
+	ints := map[string]*int{
+		"PAYMENT_MOCK_LATENCY_MS":        &p.LatencyMS,
+		"PAYMENT_MOCK_LATENCY_JITTER_MS": &p.LatencyJitterMS,
+		"PAYMENT_MOCK_RETRY_AFTER":       &p.RetryAfterSeconds,
+		"PAYMENT_MOCK_TIMEOUT_MS":        &p.TimeoutMS,
+	}
+	for name, dst := range ints {
+		if v := os.Getenv(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("failed to parse %s: %w", name, err)
+			}
+			*dst = n
+		}
+	}
+	if v := os.Getenv("PAYMENT_MOCK_FAULT_MODE"); v != "" {
+		p.Mode = v
+		// 確率を指定しなければ常に障害を起こす
+		p.Rate = 1
+	}
+	if v := os.Getenv("PAYMENT_MOCK_FAULT_RATE"); v != "" {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("failed to parse PAYMENT_MOCK_FAULT_RATE: %w", err)
+		}
+		p.Rate = rate
+	}
+	if err := p.validate(); err != nil {
+		return err
+	}
+
+	faultProfileLock.Lock()
+	faultProfile = p
+	faultProfileLock.Unlock()
+	return nil
+}
+
+func currentFaultProfile() FaultProfile {
+	faultProfileLock.RLock()
+	defer faultProfileLock.RUnlock()
+	return faultProfile
+}
+
+// 設定に従って遅延や障害を注入する
+func withFault(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := currentFaultProfile()
+
+		if latency := p.LatencyMS + jitter(p.LatencyJitterMS); latency > 0 {
+			select {
+			case <-time.After(time.Duration(latency) * time.Millisecond):
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		if p.Mode == "" || rand.Float64() >= p.Rate {
+			next(w, r)
+			return
+		}
+
+		slog.Info("障害を注入", slog.String("mode", p.Mode), slog.String("method", r.Method), slog.String("path", r.URL.Path))
+		switch p.Mode {
+		case faultModeRecorded5xx:
+			next(discardResponseWriter{header: http.Header{}}, r)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"message": "内部エラーが発生しました"})
+		case faultModeUnrecorded5xx:
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"message": "内部エラーが発生しました"})
+		case faultModeRateLimit:
+			w.Header().Set("Retry-After", strconv.Itoa(p.RetryAfterSeconds))
+			writeJSON(w, http.StatusTooManyRequests, map[string]string{"message": "リクエストが多すぎます"})
+		case faultModeTimeout:
+			next(discardResponseWriter{header: http.Header{}}, r)
+			select {
+			case <-time.After(time.Duration(p.TimeoutMS) * time.Millisecond):
+				writeJSON(w, http.StatusGatewayTimeout, map[string]string{"message": "タイムアウトしました"})
+			case <-r.Context().Done():
+			}
+		case faultModeReset:
+			hj, ok := w.(http.Hijacker)
+			if !ok {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"message": "内部エラーが発生しました"})
+				return
+			}
+			conn, _, err := hj.Hijack()
+			if err != nil {
+				slog.Error(err.Error())
+				return
+			}
+			conn.Close()
+		}
+	}
+}
+
+func jitter(maxMS int) int {
+	if maxMS <= 0 {
+		return 0
+	}
+	return rand.IntN(maxMS + 1)
+}
+
+// 処理は行うがレスポンスは捨てる
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w discardResponseWriter) Header() http.Header         { return w.header }
+func (w discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w discardResponseWriter) WriteHeader(int)             {}
+
+func handleGetFault(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, currentFaultProfile())
+}
+
+func handlePutFault(w http.ResponseWriter, r *http.Request) {
+	// 省略した項目は初期値にする
+	p := defaultFaultProfile
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "不正なリクエスト形式です"})
+		return
+	}
+	if err := p.validate(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+		return
+	}
+
+	faultProfileLock.Lock()
+	faultProfile = p
+	faultProfileLock.Unlock()
+
+	slog.Info("障害注入の設定を更新", slog.String("mode", p.Mode), slog.Float64("rate", p.Rate), slog.Int("latency_ms", p.LatencyMS))
+	writeJSON(w, http.StatusOK, p)
+}
+
+func handleDeleteFault(w http.ResponseWriter, r *http.Request) {
+	faultProfileLock.Lock()
+	faultProfile = defaultFaultProfile
+	faultProfileLock.Unlock()
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,3 +1,5 @@
 module payment_mock
 
 go 1.23
+
+require github.com/goccy/go-json v0.11.2
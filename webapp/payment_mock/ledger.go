@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+// 決済の記録を追記するファイル。PAYMENT_MOCK_LEDGER で変更でき、空文字を指定するとメモリ上にのみ保持する
+// 1行に1件の記録を JSON で追記し、起動時に先頭から再生して復元する
+var (
+	ledgerPath = "payment_mock_ledger.jsonl"
+	ledgerFile *os.File
+	// 最後まで書き切った記録の末尾の位置
+	ledgerSize int64
+)
+
+type ledgerRecord struct {
+	Op         string   `json:"op"`
+	Token      string   `json:"token,omitempty"`
+	PaymentKey string   `json:"payment_key,omitempty"`
+	Payment    *Payment `json:"payment,omitempty"`
+	Refund     *Refund  `json:"refund,omitempty"`
+}
+
+const (
+	ledgerOpPayment = "payment"
+	ledgerOpRefund  = "refund"
+	ledgerOpDelete  = "delete"
+)
+
+func loadLedger() error {
+	if v, ok := os.LookupEnv("PAYMENT_MOCK_LEDGER"); ok {
+		ledgerPath = v
+	}
+	if ledgerPath == "" {
+		return nil
+	}
+
+	f, err := os.OpenFile(ledgerPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	loaded := map[string][]Payment{}
+	records, offset := 0, int64(0)
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			// 書き込み途中で落ちた最後の行は改行で終わっていないので切り詰める
+			if errors.Is(err, io.EOF) {
+				if err := f.Truncate(offset); err != nil {
+					f.Close()
+					return err
+				}
+				break
+			}
+			f.Close()
+			return err
+		}
+		var record ledgerRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to parse %s: %w", ledgerPath, err)
+		}
+		applyLedgerRecord(loaded, record)
+		records++
+		offset += int64(len(line))
+	}
+
+	dataLock.Lock()
+	data = loaded
+	ledgerFile = f
+	ledgerSize = offset
+	dataLock.Unlock()
+
+	slog.Info("決済記録を読み込み", slog.String("path", ledgerPath), slog.Int("records", records), slog.Int("tokens", len(loaded)))
+	return nil
+}
+
+func applyLedgerRecord(payments map[string][]Payment, record ledgerRecord) {
+	switch record.Op {
+	case ledgerOpPayment:
+		payments[record.Token] = append(payments[record.Token], *record.Payment)
+	case ledgerOpRefund:
+		for i := range payments[record.Token] {
+			if payments[record.Token][i].IdempotencyKey == record.PaymentKey {
+				payments[record.Token][i].Refunds = append(payments[record.Token][i].Refunds, *record.Refund)
+				break
+			}
+		}
+	case ledgerOpDelete:
+		if record.Token == "" {
+			clear(payments)
+		} else {
+			delete(payments, record.Token)
+		}
+	}
+}
+
+// 記録をファイルに追記してからメモリに反映する。追記に失敗したらメモリも変えない
+// dataLock を取得した状態で呼ぶ
+func commitLedger(record ledgerRecord) error {
+	if ledgerFile != nil {
+		b, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		n, err := ledgerFile.Write(append(b, '\n'))
+		if err != nil {
+			// 書きかけの行が残ると次の記録と混ざるので切り詰める
+			if truncErr := ledgerFile.Truncate(ledgerSize); truncErr != nil {
+				return errors.Join(err, truncErr)
+			}
+			return err
+		}
+		ledgerSize += int64(n)
+	}
+	applyLedgerRecord(data, record)
+	return nil
+}
+
+type AdminPayment struct {
+	Token          string    `json:"token"`
+	Amount         int       `json:"amount"`
+	IdempotencyKey string    `json:"idempotency_key,omitempty"`
+	RefundedAmount int       `json:"refunded_amount"`
+	Refunds        []Refund  `json:"refunds"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// 記録されている決済を検索する
+// token, idempotency_key, min_amount, max_amount, since, until (RFC3339) で絞り込める
+func handleAdminGetPayments(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	token := q.Get("token")
+	idempotencyKey := q.Get("idempotency_key")
+
+	minAmount, maxAmount := 0, 0
+	for name, dst := range map[string]*int{"min_amount": &minAmount, "max_amount": &maxAmount} {
+		if v := q.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"message": name + " が不正です"})
+				return
+			}
+			*dst = n
+		}
+	}
+	var since, until time.Time
+	for name, dst := range map[string]*time.Time{"since": &since, "until": &until} {
+		if v := q.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"message": name + " が不正です"})
+				return
+			}
+			*dst = t
+		}
+	}
+
+	dataLock.Lock()
+	res := []AdminPayment{}
+	for t, payments := range data {
+		if token != "" && t != token {
+			continue
+		}
+		for _, payment := range payments {
+			switch {
+			case idempotencyKey != "" && payment.IdempotencyKey != idempotencyKey,
+				minAmount != 0 && payment.Amount < minAmount,
+				maxAmount != 0 && payment.Amount > maxAmount,
+				!since.IsZero() && payment.CreatedAt.Before(since),
+				!until.IsZero() && payment.CreatedAt.After(until):
+				continue
+			}
+			refunds := payment.Refunds
+			if refunds == nil {
+				refunds = []Refund{}
+			}
+			res = append(res, AdminPayment{
+				Token:          t,
+				Amount:         payment.Amount,
+				IdempotencyKey: payment.IdempotencyKey,
+				RefundedAmount: payment.refundedAmount(),
+				Refunds:        refunds,
+				CreatedAt:      payment.CreatedAt,
+			})
+		}
+	}
+	dataLock.Unlock()
+
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].CreatedAt.Before(res[j].CreatedAt)
+	})
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+// token を指定すればそのトークンの決済を、指定しなければすべての決済を消す
+func handleAdminDeletePayments(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+
+	dataLock.Lock()
+	defer dataLock.Unlock()
+
+	if err := commitLedger(ledgerRecord{Op: ledgerOpDelete, Token: token}); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"message": err.Error()})
+		return
+	}
+
+	slog.Info("決済記録を削除", slog.String("token", token))
+	w.WriteHeader(http.StatusNoContent)
+}
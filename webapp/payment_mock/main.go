@@ -4,21 +4,64 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
+	"os"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/goccy/go-json"
 )
 
+type Payment struct {
+	Amount         int       `json:"amount"`
+	IdempotencyKey string    `json:"idempotency_key,omitempty"`
+	Refunds        []Refund  `json:"refunds,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+type Refund struct {
+	Amount         int       `json:"amount"`
+	IdempotencyKey string    `json:"idempotency_key,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+func (p *Payment) refundedAmount() int {
+	refunded := 0
+	for _, refund := range p.Refunds {
+		refunded += refund.Amount
+	}
+	return refunded
+}
+
 var (
-	data     = map[string][]int{}
+	data     = map[string][]Payment{}
 	dataLock sync.Mutex
 )
 
 func main() {
+	if err := loadFaultProfileFromEnv(); err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+	if err := loadLedger(); err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
 	mux := http.NewServeMux()
-	mux.HandleFunc("GET /payments", handleGetPayments)
-	mux.HandleFunc("POST /payments", handlePostPayments)
+	mux.HandleFunc("GET /payments", withFault(handleGetPayments))
+	mux.HandleFunc("POST /payments", withFault(handlePostPayments))
+	mux.HandleFunc("POST /payments/{payment_key}/refunds", withFault(handlePostRefunds))
+
+	// 障害注入の設定
+	mux.HandleFunc("GET /admin/fault", handleGetFault)
+	mux.HandleFunc("PUT /admin/fault", handlePutFault)
+	mux.HandleFunc("DELETE /admin/fault", handleDeleteFault)
+
+	// 記録されている決済の確認
+	mux.HandleFunc("GET /admin/payments", handleAdminGetPayments)
+	mux.HandleFunc("DELETE /admin/payments", handleAdminDeletePayments)
+
 	http.ListenAndServe(":12345", mux)
 }
 
@@ -44,23 +87,113 @@ func handlePostPayments(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+
 	// モックサーバーは任意のトークンを受け付けて、決済を記録する
 	dataLock.Lock()
-	arr, ok := data[token]
-	if !ok {
-		arr = []int{}
-		data[token] = arr
+	defer dataLock.Unlock()
+
+	// 同じIdempotency-Keyの決済が記録済みなら、再度決済せずに成功として扱う
+	if idempotencyKey != "" {
+		for _, payment := range data[token] {
+			if payment.IdempotencyKey == idempotencyKey {
+				slog.Info("決済済み", slog.String("token", token), slog.String("idempotency_key", idempotencyKey))
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+	}
+
+	payment := Payment{
+		Amount:         req.Amount,
+		IdempotencyKey: idempotencyKey,
+		CreatedAt:      time.Now(),
+	}
+	if err := commitLedger(ledgerRecord{Op: ledgerOpPayment, Token: token, Payment: &payment}); err != nil {
+		slog.Error("決済記録の保存に失敗", slog.String("error", err.Error()))
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"message": "決済記録の保存に失敗しました"})
+		return
 	}
-	arr = append(arr, req.Amount)
-	dataLock.Unlock()
 
-	slog.Info("決済完了", slog.String("token", token), slog.Int("amount", req.Amount))
+	slog.Info("決済完了", slog.String("token", token), slog.Int("amount", req.Amount), slog.String("idempotency_key", idempotencyKey))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type PostRefundsRequest struct {
+	Amount int `json:"amount"`
+}
+
+// Idempotency-Key を指定して決済した決済の全額または一部を返金する
+func handlePostRefunds(w http.ResponseWriter, r *http.Request) {
+	token, err := getTokenFromAuthorizationHeader(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+		return
+	}
+	paymentKey := r.PathValue("payment_key")
+
+	var req PostRefundsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "不正なリクエスト形式です"})
+		return
+	}
+	if req.Amount <= 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "返金額が不正です"})
+		return
+	}
+
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+
+	dataLock.Lock()
+	defer dataLock.Unlock()
+
+	var payment *Payment
+	for i := range data[token] {
+		if data[token][i].IdempotencyKey == paymentKey {
+			payment = &data[token][i]
+			break
+		}
+	}
+	if payment == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "決済が見つかりません"})
+		return
+	}
+
+	// 同じIdempotency-Keyの返金が記録済みなら、再度返金せずに成功として扱う
+	if idempotencyKey != "" {
+		for _, refund := range payment.Refunds {
+			if refund.IdempotencyKey == idempotencyKey {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+	}
+
+	if payment.refundedAmount()+req.Amount > payment.Amount {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "返金額が決済額を超えています"})
+		return
+	}
+
+	refund := Refund{
+		Amount:         req.Amount,
+		IdempotencyKey: idempotencyKey,
+		CreatedAt:      time.Now(),
+	}
+	if err := commitLedger(ledgerRecord{Op: ledgerOpRefund, Token: token, PaymentKey: paymentKey, Refund: &refund}); err != nil {
+		slog.Error("決済記録の保存に失敗", slog.String("error", err.Error()))
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"message": "決済記録の保存に失敗しました"})
+		return
+	}
+
+	slog.Info("返金完了", slog.String("token", token), slog.String("payment_key", paymentKey), slog.Int("amount", req.Amount))
 	w.WriteHeader(http.StatusNoContent)
 }
 
 type ResponsePayment struct {
-	Amount int    `json:"amount"`
-	Status string `json:"status"`
+	Amount         int    `json:"amount"`
+	Status         string `json:"status"`
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	RefundedAmount int    `json:"refunded_amount"`
 }
 
 func handleGetPayments(w http.ResponseWriter, r *http.Request) {
@@ -71,16 +204,18 @@ func handleGetPayments(w http.ResponseWriter, r *http.Request) {
 	}
 
 	dataLock.Lock()
-	arr, _ := data[token]
-	dataLock.Unlock()
-
+	arr := data[token]
 	res := make([]ResponsePayment, 0, len(arr))
-	for _, amount := range arr {
+	for _, payment := range arr {
 		res = append(res, ResponsePayment{
-			Amount: amount,
-			Status: "成功",
+			Amount:         payment.Amount,
+			Status:         "成功",
+			IdempotencyKey: payment.IdempotencyKey,
+			RefundedAmount: payment.refundedAmount(),
 		})
 	}
+	dataLock.Unlock()
+
 	writeJSON(w, http.StatusOK, res)
 }
 
@@ -48,6 +48,18 @@ CREATE TABLE chair_locations
 )
   COMMENT = '椅子の現在位置情報テーブル';
 
+DROP TABLE IF EXISTS chair_distances;
+CREATE TABLE chair_distances
+(
+  chair_id       VARCHAR(26) NOT NULL COMMENT '椅子ID',
+  total_distance INTEGER     NOT NULL COMMENT '累計移動距離',
+  latitude       INTEGER     NOT NULL COMMENT '最後に送信された経度',
+  longitude      INTEGER     NOT NULL COMMENT '最後に送信された緯度',
+  updated_at     DATETIME(6) NOT NULL COMMENT '最後に位置情報を送信した日時',
+  PRIMARY KEY (chair_id)
+)
+  COMMENT = '椅子の累計移動距離テーブル';
+
 DROP TABLE IF EXISTS users;
 CREATE TABLE users
 (
@@ -135,6 +147,197 @@ CREATE TABLE coupons
 )
   COMMENT 'クーポンテーブル';
 
+DROP TABLE IF EXISTS invitations;
+CREATE TABLE invitations
+(
+  invitee_id         VARCHAR(26)  NOT NULL COMMENT '招待されたユーザーのID',
+  inviter_id         VARCHAR(26)  NOT NULL COMMENT '招待したユーザーのID',
+  invitation_code    VARCHAR(30)  NOT NULL COMMENT '使用された招待コード',
+  reward_coupon_code VARCHAR(255) NULL COMMENT '招待したユーザーに付与したクーポンのコード',
+  created_at         DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '招待日時',
+  PRIMARY KEY (invitee_id)
+)
+  COMMENT '招待履歴テーブル';
+
+DROP TABLE IF EXISTS fraud_flags;
+CREATE TABLE fraud_flags
+(
+  id          VARCHAR(26)                    NOT NULL,
+  user_id     VARCHAR(26)                    NOT NULL COMMENT '検知されたユーザーのID',
+  reason      VARCHAR(50)                    NOT NULL COMMENT '検知理由',
+  score       INTEGER                        NOT NULL COMMENT '不正スコア',
+  detail      TEXT                           NOT NULL COMMENT '検知内容の詳細',
+  created_at  DATETIME(6)                    NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '検知日時',
+  reviewed_at DATETIME(6)                    NULL COMMENT 'レビュー日時',
+  resolution  ENUM ('released', 'revoked')   NULL COMMENT 'レビュー結果',
+  PRIMARY KEY (id)
+)
+  COMMENT '不正利用の検知テーブル';
+
+DROP TABLE IF EXISTS payments;
+CREATE TABLE payments
+(
+  id              VARCHAR(26)                                NOT NULL COMMENT '決済ID',
+  ride_id         VARCHAR(26)                                NOT NULL COMMENT 'ライドID',
+  user_id         VARCHAR(26)                                NOT NULL COMMENT 'ユーザーID',
+  token           VARCHAR(255)                               NOT NULL COMMENT '決済トークン',
+  amount          INTEGER                                    NOT NULL COMMENT '決済額',
+  status          ENUM ('pending', 'succeeded', 'failed')   NOT NULL DEFAULT 'pending' COMMENT '決済状態',
+  attempts        INTEGER                                    NOT NULL DEFAULT 0 COMMENT '試行回数',
+  last_error      TEXT                                       NULL COMMENT '最後の失敗理由',
+  next_attempt_at DATETIME(6)                                NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '次回試行日時',
+  created_at      DATETIME(6)                                NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '作成日時',
+  updated_at      DATETIME(6)                                NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6) COMMENT '更新日時',
+  PRIMARY KEY (id),
+  UNIQUE (ride_id)
+)
+  COMMENT '決済のアウトボックステーブル';
+
+DROP TABLE IF EXISTS refunds;
+CREATE TABLE refunds
+(
+  id              VARCHAR(26)                              NOT NULL COMMENT '返金ID',
+  payment_id      VARCHAR(26)                              NOT NULL COMMENT '決済ID',
+  ride_id         VARCHAR(26)                              NOT NULL COMMENT 'ライドID',
+  amount          INTEGER                                  NOT NULL COMMENT '返金額',
+  reason          TEXT                                     NOT NULL COMMENT '返金理由',
+  status          ENUM ('pending', 'succeeded', 'failed') NOT NULL DEFAULT 'pending' COMMENT '返金状態',
+  attempts        INTEGER                                  NOT NULL DEFAULT 0 COMMENT '試行回数',
+  last_error      TEXT                                     NULL COMMENT '最後の失敗理由',
+  next_attempt_at DATETIME(6)                              NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '次回試行日時',
+  created_at      DATETIME(6)                              NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '作成日時',
+  updated_at      DATETIME(6)                              NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6) COMMENT '更新日時',
+  PRIMARY KEY (id)
+)
+  COMMENT '返金テーブル';
+
+DROP TABLE IF EXISTS chair_register_tokens;
+CREATE TABLE chair_register_tokens
+(
+  id               VARCHAR(26)  NOT NULL COMMENT 'トークンID',
+  owner_id         VARCHAR(26)  NOT NULL COMMENT 'オーナーID',
+  token            VARCHAR(255) NOT NULL COMMENT '椅子登録トークン',
+  max_chairs       INTEGER      NULL COMMENT '登録できる椅子の数の上限',
+  registered_count INTEGER      NOT NULL DEFAULT 0 COMMENT '登録した椅子の数',
+  model            VARCHAR(50)  NULL COMMENT '登録できる椅子のモデル',
+  expires_at       DATETIME(6)  NULL COMMENT '有効期限',
+  revoked_at       DATETIME(6)  NULL COMMENT '無効化日時',
+  created_at       DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '発行日時',
+  PRIMARY KEY (id),
+  UNIQUE (token)
+)
+  COMMENT '制限付きの椅子登録トークンテーブル';
+
+DROP TABLE IF EXISTS chair_registrations;
+CREATE TABLE chair_registrations
+(
+  id                VARCHAR(26)                     NOT NULL COMMENT 'ID',
+  owner_id          VARCHAR(26)                     NULL COMMENT 'トークンから特定できたオーナーID',
+  register_token_id VARCHAR(26)                     NULL COMMENT '制限付きトークンのID。オーナーのトークンならNULL',
+  chair_id          VARCHAR(26)                     NULL COMMENT '登録した椅子ID',
+  name              VARCHAR(255)                    NOT NULL COMMENT '要求された椅子の名前',
+  model             VARCHAR(255)                    NOT NULL COMMENT '要求された椅子のモデル',
+  result            ENUM ('succeeded', 'rejected') NOT NULL COMMENT '結果',
+  reason            VARCHAR(255)                    NULL COMMENT '拒否した理由',
+  remote_addr       VARCHAR(255)                    NOT NULL COMMENT '接続元',
+  user_agent        TEXT                            NOT NULL COMMENT 'User-Agent',
+  created_at        DATETIME(6)                     NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  PRIMARY KEY (id)
+)
+  COMMENT '椅子登録の監査ログテーブル';
+
+DROP TABLE IF EXISTS chair_activities;
+CREATE TABLE chair_activities
+(
+  id         BIGINT       NOT NULL AUTO_INCREMENT COMMENT 'ID',
+  chair_id   VARCHAR(26)  NOT NULL COMMENT '椅子ID',
+  is_active  TINYINT(1)   NOT NULL COMMENT '変更後の受付状態',
+  reason     VARCHAR(255) NOT NULL COMMENT '変更の理由',
+  created_at DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '変更日時',
+  PRIMARY KEY (id)
+)
+  COMMENT '椅子の受付状態の変更履歴テーブル';
+
+DROP TABLE IF EXISTS owner_notifications;
+CREATE TABLE owner_notifications
+(
+  id         VARCHAR(26)  NOT NULL COMMENT 'ID',
+  owner_id   VARCHAR(26)  NOT NULL COMMENT 'オーナーID',
+  chair_id   VARCHAR(26)  NULL COMMENT '対象の椅子ID',
+  type       VARCHAR(50)  NOT NULL COMMENT '通知の種類',
+  message    TEXT         NOT NULL COMMENT '本文',
+  created_at DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '通知日時',
+  read_at    DATETIME(6)  NULL COMMENT '既読日時',
+  PRIMARY KEY (id)
+)
+  COMMENT 'オーナーへの通知テーブル';
+
+DROP TABLE IF EXISTS ride_support_flags;
+CREATE TABLE ride_support_flags
+(
+  id          VARCHAR(26)  NOT NULL COMMENT 'ID',
+  ride_id     VARCHAR(26)  NOT NULL COMMENT 'ライドID',
+  chair_id    VARCHAR(26)  NOT NULL COMMENT '椅子ID',
+  reason      VARCHAR(50)  NOT NULL COMMENT '理由',
+  detail      TEXT         NOT NULL COMMENT '詳細',
+  created_at  DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  resolved_at DATETIME(6)  NULL COMMENT '対応完了日時',
+  PRIMARY KEY (id)
+)
+  COMMENT 'サポートの対応が必要なライドのテーブル';
+
+DROP TABLE IF EXISTS ride_sales;
+CREATE TABLE ride_sales
+(
+  ride_id      VARCHAR(26) NOT NULL COMMENT 'ライドID',
+  owner_id     VARCHAR(26) NOT NULL COMMENT '椅子のオーナーID',
+  chair_id     VARCHAR(26) NOT NULL COMMENT '椅子ID',
+  fare         INTEGER     NOT NULL COMMENT '割引前の運賃',
+  discount     INTEGER     NOT NULL COMMENT 'クーポンによる割引額',
+  charged      INTEGER     NOT NULL COMMENT '実際に請求した額',
+  completed_at DATETIME(6) NOT NULL COMMENT '完了日時',
+  PRIMARY KEY (ride_id)
+)
+  COMMENT '完了したライドの売上テーブル';
+
+DROP TABLE IF EXISTS ledger_entries;
+CREATE TABLE ledger_entries
+(
+  id             VARCHAR(26)  NOT NULL COMMENT '仕訳明細ID',
+  transaction_id VARCHAR(26)  NOT NULL COMMENT '取引ID。同じ取引の明細の金額の合計は0になる',
+  account        VARCHAR(30)  NOT NULL COMMENT '勘定科目',
+  amount         INTEGER      NOT NULL COMMENT '金額。借方を正、貸方を負とする',
+  owner_id       VARCHAR(26)  NULL COMMENT '関係する椅子のオーナーID',
+  ride_id        VARCHAR(26)  NULL COMMENT '関係するライドID',
+  payout_id      VARCHAR(26)  NULL COMMENT '関係する支払いID',
+  created_at     DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '計上日時',
+  PRIMARY KEY (id)
+)
+  COMMENT '複式簿記の仕訳テーブル';
+
+DROP TABLE IF EXISTS payout_periods;
+CREATE TABLE payout_periods
+(
+  period_start DATE        NOT NULL COMMENT '締めた期間の開始日(UTC)',
+  closed_at    DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '締めた日時',
+  PRIMARY KEY (period_start)
+)
+  COMMENT '締め済みの支払い期間テーブル';
+
+DROP TABLE IF EXISTS owner_payouts;
+CREATE TABLE owner_payouts
+(
+  id           VARCHAR(26) NOT NULL COMMENT '支払いID',
+  owner_id     VARCHAR(26) NOT NULL COMMENT 'オーナーID',
+  period_start DATE        NOT NULL COMMENT '期間の開始日(UTC)',
+  amount       INTEGER     NOT NULL COMMENT '支払額',
+  ride_count   INTEGER     NOT NULL COMMENT '期間中のライド数',
+  created_at   DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '作成日時',
+  PRIMARY KEY (id),
+  UNIQUE (owner_id, period_start)
+)
+  COMMENT 'オーナーへの支払いテーブル';
+
 
 
 
@@ -145,3 +348,19 @@ CREATE INDEX idx_ride_id_chair_sent_at_created_at ON ride_statuses(ride_id, chai
 CREATE INDEX idx_ride_statuses_ride_id_sent_at ON ride_statuses (ride_id, chair_sent_at);
 CREATE INDEX idx_rides_chair_id_updated_at ON rides (chair_id, updated_at);
 CREATE INDEX idx_chair_id_created_at_desc ON chair_locations(chair_id, created_at DESC);
+CREATE INDEX idx_inviter_id_created_at ON invitations(inviter_id, created_at);
+CREATE INDEX idx_fraud_flags_user_id ON fraud_flags(user_id, reviewed_at);
+CREATE INDEX idx_payment_tokens_token ON payment_tokens(token);
+CREATE INDEX idx_users_name_date_of_birth ON users(firstname, lastname, date_of_birth);
+CREATE INDEX idx_payments_status_next_attempt_at ON payments(status, next_attempt_at);
+CREATE INDEX idx_payments_token ON payments(token);
+CREATE INDEX idx_refunds_ride_id ON refunds(ride_id);
+CREATE INDEX idx_ledger_entries_owner_id_created_at ON ledger_entries(owner_id, created_at);
+CREATE INDEX idx_ledger_entries_ride_id ON ledger_entries(ride_id);
+CREATE INDEX idx_ride_sales_owner_id_completed_at ON ride_sales(owner_id, completed_at);
+CREATE INDEX idx_chair_register_tokens_owner_id ON chair_register_tokens(owner_id);
+CREATE INDEX idx_chair_registrations_owner_id_created_at ON chair_registrations(owner_id, created_at);
+CREATE INDEX idx_chair_activities_chair_id_created_at ON chair_activities(chair_id, created_at);
+CREATE INDEX idx_owner_notifications_owner_id_created_at ON owner_notifications(owner_id, created_at);
+CREATE INDEX idx_ride_support_flags_ride_id ON ride_support_flags(ride_id, resolved_at);
+CREATE INDEX idx_refunds_status_next_attempt_at ON refunds(status, next_attempt_at);
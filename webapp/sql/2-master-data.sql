@@ -4,7 +4,21 @@ SET CHARACTER_SET_CONNECTION = utf8mb4;
 USE isuride;
 
 INSERT INTO settings (name, value)
-VALUES ('payment_gateway_url', 'http://localhost:12345');
+VALUES ('payment_gateway_url', 'http://localhost:12345'),
+       ('invitation_max_uses', '3'),
+       ('invitation_invitee_discount', '1500'),
+       ('invitation_inviter_reward', '1000'),
+       ('platform_fee_rate', '20'),
+       ('chair_heartbeat_timeout', '0'),
+       ('fraud_hold_threshold', '70'),
+       ('fraud_score_window', '604800'),
+       ('fraud_score_shared_token', '70'),
+       ('fraud_score_dup_identity', '40'),
+       ('fraud_score_invite_burst', '30'),
+       ('fraud_score_invite_chain', '20'),
+       ('fraud_burst_window', '600'),
+       ('fraud_burst_count', '2'),
+       ('fraud_chain_window', '3600');
 
 INSERT INTO chair_models (name, speed)
 VALUES ('リラックスシート NEO', 2),
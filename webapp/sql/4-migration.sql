@@ -0,0 +1,89 @@
+SET CHARACTER_SET_CLIENT = utf8mb4;
+SET CHARACTER_SET_CONNECTION = utf8mb4;
+
+USE isuride;
+
+-- 3-initial-data.sql はカラム名なしの INSERT なので、既存テーブルへのカラム追加は初期データ投入後にここで行う
+
+ALTER TABLE coupons
+  ADD COLUMN type         ENUM ('fixed', 'percentage', 'free_base_fare') NOT NULL DEFAULT 'fixed' COMMENT 'クーポン種別',
+  ADD COLUMN max_discount INTEGER                                      NULL COMMENT '割引額の上限(percentageのみ)',
+  ADD COLUMN min_fare     INTEGER                                      NOT NULL DEFAULT 0 COMMENT '適用に必要な最低運賃',
+  ADD COLUMN expires_at   DATETIME(6)                                  NULL COMMENT '有効期限',
+  ADD COLUMN held_at      DATETIME(6)                                  NULL COMMENT '不正検知による利用保留日時',
+  ADD COLUMN held_by      VARCHAR(26)                                  NULL COMMENT '保留のきっかけになった不正検知のID';
+
+-- 既存の招待クーポンから招待履歴を復元する
+INSERT INTO invitations (invitee_id, inviter_id, invitation_code, created_at)
+SELECT c.user_id, u.id, u.invitation_code, c.created_at
+FROM coupons c
+JOIN users u ON c.code = CONCAT('INV_', u.invitation_code);
+-- 招待したユーザーには招待ごとに RWD_<招待コード>_<UnixMilli> のクーポンを付与しているので、古い順に対応付ける
+UPDATE invitations i
+JOIN (
+  SELECT invitee_id, inviter_id, ROW_NUMBER() OVER (PARTITION BY inviter_id ORDER BY created_at, invitee_id) AS n
+  FROM invitations
+) inv ON inv.invitee_id = i.invitee_id
+JOIN (
+  SELECT c.user_id, c.code, ROW_NUMBER() OVER (PARTITION BY c.user_id ORDER BY c.created_at, c.code) AS n
+  FROM coupons c
+  JOIN users u ON u.id = c.user_id
+  WHERE LEFT(c.code, CHAR_LENGTH(u.invitation_code) + 5) = CONCAT('RWD_', u.invitation_code, '_')
+) rwd ON rwd.user_id = inv.inviter_id AND rwd.n = inv.n
+SET i.reward_coupon_code = rwd.code;
+
+-- 1ユーザーが複数の決済手段を登録できるようにする
+ALTER TABLE payment_tokens
+  ADD COLUMN id         VARCHAR(26)  NULL COMMENT '決済手段ID' FIRST,
+  ADD COLUMN label      VARCHAR(255) NOT NULL DEFAULT '' COMMENT '表示名',
+  ADD COLUMN is_default TINYINT(1)   NOT NULL DEFAULT 0 COMMENT 'デフォルトの決済手段か',
+  ADD COLUMN deleted_at DATETIME(6)  NULL COMMENT '削除日時';
+-- 既存の決済トークンはユーザーIDをそのまま決済手段IDとする
+UPDATE payment_tokens SET id = user_id, is_default = 1;
+ALTER TABLE payment_tokens
+  MODIFY COLUMN id VARCHAR(26) NOT NULL COMMENT '決済手段ID',
+  DROP PRIMARY KEY,
+  ADD PRIMARY KEY (id);
+CREATE INDEX idx_payment_tokens_user_id ON payment_tokens(user_id);
+
+ALTER TABLE rides
+  ADD COLUMN payment_token_id VARCHAR(26) NULL COMMENT '決済手段ID';
+UPDATE rides JOIN payment_tokens ON payment_tokens.id = rides.user_id SET rides.payment_token_id = payment_tokens.id;
+CREATE INDEX idx_rides_payment_token_id ON rides(payment_token_id);
+
+-- 初期データの完了済みライドの売上を記録する。初期データのクーポンはすべて定額割引
+INSERT INTO ride_sales (ride_id, owner_id, chair_id, fare, discount, charged, completed_at)
+SELECT t.id, t.owner_id, t.chair_id, 500 + t.metered, LEAST(t.discount, t.metered), 500 + t.metered - LEAST(t.discount, t.metered), t.updated_at
+FROM (
+  SELECT r.id, ch.owner_id, r.chair_id, r.updated_at,
+         100 * (ABS(r.destination_latitude - r.pickup_latitude) + ABS(r.destination_longitude - r.pickup_longitude)) AS metered,
+         IFNULL(cp.discount, 0) AS discount
+  FROM rides r
+  JOIN chairs ch ON ch.id = r.chair_id
+  LEFT JOIN coupons cp ON cp.used_by = r.id
+  WHERE EXISTS (SELECT 1 FROM ride_statuses rs WHERE rs.ride_id = r.id AND rs.status = 'COMPLETED')
+) t;
+
+-- オーナーによる椅子の管理
+ALTER TABLE chairs
+  ADD COLUMN suspended_at DATETIME(6) NULL COMMENT 'オーナーが強制的に受付を停止した日時',
+  ADD COLUMN retired_at   DATETIME(6) NULL COMMENT '引退日時';
+
+ALTER TABLE rides
+  ADD COLUMN matched_at DATETIME(6) NULL COMMENT '椅子を割り当てた日時';
+
+-- 受付中の椅子は、最後に更新された時点から受付中だったとみなす
+INSERT INTO chair_activities (chair_id, is_active, reason, created_at)
+SELECT id, TRUE, 'initial', updated_at FROM chairs WHERE is_active = TRUE;
+
+-- 初期データの位置情報から椅子ごとの累計移動距離を作る
+INSERT INTO chair_distances (chair_id, total_distance, latitude, longitude, updated_at)
+SELECT chair_id, IFNULL(SUM(distance), 0), MAX(last_latitude), MAX(last_longitude), MAX(created_at) FROM (
+  SELECT chair_id, created_at,
+         ABS(latitude - LAG(latitude) OVER w) + ABS(longitude - LAG(longitude) OVER w) AS distance,
+         LAST_VALUE(latitude) OVER (w ROWS BETWEEN UNBOUNDED PRECEDING AND UNBOUNDED FOLLOWING) AS last_latitude,
+         LAST_VALUE(longitude) OVER (w ROWS BETWEEN UNBOUNDED PRECEDING AND UNBOUNDED FOLLOWING) AS last_longitude
+  FROM chair_locations
+  WINDOW w AS (PARTITION BY chair_id ORDER BY created_at)
+) distances
+GROUP BY chair_id;